@@ -2,6 +2,7 @@ package app
 
 import (
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -12,28 +13,171 @@ import (
 	"github.com/cmars/onionpipe/secrets"
 )
 
-var forwardFlags = []cli.Flag{
-	&cli.BoolFlag{
-		Name:  "debug",
-		Usage: "enable debug log output",
-	},
-	&cli.BoolFlag{
-		Name:  "anonymous",
-		Usage: "publish anonymous hidden services",
-		Value: true,
-	},
-	&cli.PathFlag{
-		Name:  "secrets",
-		Usage: "path where service and client secrets are stored",
-	},
-	&cli.StringSliceFlag{
-		Name:  "require-auth",
-		Usage: "require client authorization from public keys for all exported onion services",
-	},
-	&cli.StringFlag{
-		Name:  "auth",
-		Usage: "import onion services with this client authorization (name or private key)",
-	},
+func debugFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:    "debug",
+		Usage:   "enable debug log output",
+		EnvVars: []string{"ONIONPIPE_DEBUG"},
+	}
+}
+
+func anonymousFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:    "anonymous",
+		Usage:   "publish anonymous hidden services",
+		Value:   true,
+		EnvVars: []string{"ONIONPIPE_ANONYMOUS"},
+	}
+}
+
+// commonFlags returns the flags of all commands which export local services
+// with Tor. Flags are created for each app, as flags set from the environment
+// keep their values.
+func commonFlags() []cli.Flag {
+	return []cli.Flag{
+		debugFlag(),
+		anonymousFlag(),
+		&cli.PathFlag{
+			Name:    "secrets",
+			Usage:   "path where service and client secrets are stored",
+			EnvVars: []string{"ONIONPIPE_SECRETS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "require-auth",
+			Usage:   "require client authorization from public keys for all exported onion services",
+			EnvVars: []string{"ONIONPIPE_REQUIRE_AUTH"},
+		},
+	}
+}
+
+// forwardFlags returns the flags of commands which forward.
+func forwardFlags() []cli.Flag {
+	return append(commonFlags(),
+		&cli.StringFlag{
+			Name:    "auth",
+			Usage:   "import onion services with this client authorization (name or private key)",
+			EnvVars: []string{"ONIONPIPE_AUTH"},
+		},
+		&cli.StringFlag{
+			Name:    "forwards",
+			Usage:   "forward expressions separated by whitespace, in addition to those given as arguments",
+			EnvVars: []string{"ONIONPIPE_FORWARDS"},
+		},
+		&cli.PathFlag{
+			Name:    "config",
+			Usage:   "read forwards from a JSON configuration file",
+			EnvVars: []string{"ONIONPIPE_CONFIG"},
+		},
+		&cli.IntFlag{
+			Name:    "max-conns",
+			Usage:   "maximum concurrent connections per forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_MAX_CONNS"},
+		},
+		&cli.DurationFlag{
+			Name:    "idle-timeout",
+			Usage:   "close connections idle for this long, per forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_IDLE_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "max-lifetime",
+			Usage:   "close connections open for this long, per forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_MAX_LIFETIME"},
+		},
+		&cli.DurationFlag{
+			Name:    "dial-timeout",
+			Usage:   "give up connecting to a forward's source after this long, per forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_DIAL_TIMEOUT"},
+		},
+		&cli.StringFlag{
+			Name:    "rate",
+			Usage:   "limit bytes per second in each direction (with K, M or G suffix), per forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_RATE"},
+		},
+		&cli.StringFlag{
+			Name:    "conn-rate",
+			Usage:   "limit bytes per second in each direction (with K, M or G suffix), per connection of each forward given as an argument",
+			EnvVars: []string{"ONIONPIPE_CONN_RATE"},
+		},
+		&cli.DurationFlag{
+			Name:    "dial-retry",
+			Usage:   "retry failed dials to imported onions with backoff for this long, holding local connections open",
+			EnvVars: []string{"ONIONPIPE_DIAL_RETRY"},
+		},
+		&cli.BoolFlag{
+			Name:    "prewarm",
+			Usage:   "connect to imported onions on startup, to fetch descriptors and build circuits in advance",
+			EnvVars: []string{"ONIONPIPE_PREWARM"},
+		},
+		&cli.StringFlag{
+			Name:    "isolation",
+			Usage:   "isolate connections to imported onions onto separate circuits, per destination, client or connection",
+			Value:   "none",
+			EnvVars: []string{"ONIONPIPE_ISOLATION"},
+		},
+		&cli.BoolFlag{
+			Name:    "local-tls",
+			Usage:   "terminate TLS on the local side of imports, with a self-signed certificate unless --tls-cert and --tls-key are given",
+			EnvVars: []string{"ONIONPIPE_LOCAL_TLS"},
+		},
+		&cli.PathFlag{
+			Name:    "tls-cert",
+			Usage:   "PEM certificate served by imports with --local-tls",
+			EnvVars: []string{"ONIONPIPE_TLS_CERT"},
+		},
+		&cli.PathFlag{
+			Name:    "tls-key",
+			Usage:   "PEM private key served by imports with --local-tls",
+			EnvVars: []string{"ONIONPIPE_TLS_KEY"},
+		},
+		&cli.StringFlag{
+			Name:    "remote-tls-fingerprint",
+			Usage:   "originate TLS to imported onions, pinning their certificate to this SHA-256 fingerprint",
+			EnvVars: []string{"ONIONPIPE_REMOTE_TLS_FINGERPRINT"},
+		},
+		&cli.PathFlag{
+			Name:    "remote-tls-ca",
+			Usage:   "originate TLS to imported onions, verifying their certificate with this PEM CA bundle",
+			EnvVars: []string{"ONIONPIPE_REMOTE_TLS_CA"},
+		},
+		&cli.StringFlag{
+			Name:    "remote-tls-server-name",
+			Usage:   "server name verified in the certificate of imported onions, rather than the onion address",
+			EnvVars: []string{"ONIONPIPE_REMOTE_TLS_SERVER_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "access-log",
+			Usage:   "log each connection of forwards given as arguments to this file, or - for stderr",
+			EnvVars: []string{"ONIONPIPE_ACCESS_LOG"},
+		},
+		&cli.StringFlag{
+			Name:    "access-log-format",
+			Usage:   "access log format, json or common",
+			Value:   "json",
+			EnvVars: []string{"ONIONPIPE_ACCESS_LOG_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:    "access-log-max-size",
+			Usage:   "rotate the access log file at this size (with K, M or G suffix)",
+			EnvVars: []string{"ONIONPIPE_ACCESS_LOG_MAX_SIZE"},
+		},
+		&cli.StringFlag{
+			Name:    "address-family",
+			Usage:   "prefer ipv4 or ipv6 addresses when resolving host names in forwards given as arguments",
+			Value:   "ipv4",
+			EnvVars: []string{"ONIONPIPE_ADDRESS_FAMILY"},
+		},
+		&cli.StringFlag{
+			Name:    "resolve",
+			Usage:   "resolve source host names of forwards given as arguments once, on each dial, or again after a duration such as 30s",
+			Value:   "once",
+			EnvVars: []string{"ONIONPIPE_RESOLVE"},
+		},
+		&cli.StringFlag{
+			Name:    "metrics-listen",
+			Usage:   "serve Prometheus metrics on this address, at /metrics",
+			EnvVars: []string{"ONIONPIPE_METRICS_LISTEN"},
+		},
+	)
 }
 
 func defaultSecretsPath() string {
@@ -50,14 +194,39 @@ func App() *cli.App {
 	return &cli.App{
 		Name:   "onionpipe",
 		Usage:  "forward services through Tor; .onion addresses for anything",
-		Flags:  forwardFlags,
+		Flags:  forwardFlags(),
 		Action: Forward,
 		Commands: []*cli.Command{{
 			Name:    "forward",
 			Aliases: []string{"fwd"},
 			Usage:   "forward socket address through Tor network",
-			Flags:   forwardFlags,
+			Flags:   forwardFlags(),
 			Action:  Forward,
+		}, {
+			Name:      "serve",
+			Usage:     "share local directories with a built-in HTTP file server",
+			ArgsUsage: "DIR[~PORT[@ALIAS]] ...",
+			Flags:     serveFlags(),
+			Action:    Serve,
+		}, {
+			Name:      "send",
+			Usage:     "send a file or directory once, to the holder of the printed share string",
+			ArgsUsage: "PATH",
+			Flags:     sendFlags(),
+			Action:    Send,
+		}, {
+			Name:      "receive",
+			Aliases:   []string{"recv"},
+			Usage:     "receive a file or directory from a sender",
+			ArgsUsage: "SHARE",
+			Flags:     receiveFlags(),
+			Action:    Receive,
+		}, {
+			Name:      "validate",
+			Usage:     "check forwards without starting Tor, exiting non-zero on problems",
+			ArgsUsage: "[FORWARD ...]",
+			Flags:     forwardFlags(),
+			Action:    Validate,
 		}, {
 			Name:  "service",
 			Usage: "manage onion services",
@@ -103,6 +272,34 @@ func App() *cli.App {
 				Action:  RemoveClientKey,
 			}},
 			Action: ListClientKeys,
+		}, {
+			Name:  "contact",
+			Usage: "manage the address book of onion services to import by name",
+			Subcommands: []*cli.Command{{
+				Name:    "list",
+				Aliases: []string{"ls"},
+				Usage:   "list contacts",
+				Action:  ListContacts,
+			}, {
+				Name:      "add",
+				Usage:     "add a contact, imported as onion://NAME:PORT",
+				ArgsUsage: "NAME ONION",
+				Description: "Contacts are imported by name only in onion URLs, as in onion://NAME:PORT~8080.\n" +
+					"A bare NAME:PORT~8080 exports a local host of that name instead.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "auth",
+						Usage: "import the contact with this client authorization (name or private key)",
+					},
+				},
+				Action: AddContact,
+			}, {
+				Name:    "remove",
+				Aliases: []string{"rm"},
+				Usage:   "remove contact",
+				Action:  RemoveContact,
+			}},
+			Action: ListContacts,
 		}},
 	}
 }
@@ -123,3 +320,17 @@ func openSecrets(ctx *cli.Context) (*secrets.Secrets, error) {
 	}
 	return secrets.ReadFile(secretsPath(secPath, ctx.Bool("anonymous")))
 }
+
+// readSecrets returns the secrets store, without creating it if it does not
+// exist yet.
+func readSecrets(ctx *cli.Context) (*secrets.Secrets, error) {
+	secPath := ctx.Path("secrets")
+	if secPath == "" {
+		secPath = defaultSecretsPath()
+	}
+	secPath = secretsPath(secPath, ctx.Bool("anonymous"))
+	if _, err := os.Stat(secPath); os.IsNotExist(err) {
+		return &secrets.Secrets{}, nil
+	}
+	return secrets.ReadFile(secPath)
+}
@@ -2,14 +2,20 @@ package app
 
 import (
 	"context"
+	"io"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/mitchellh/go-homedir"
 
 	"github.com/cmars/onionpipe/config"
 	"github.com/cmars/onionpipe/forwarding"
+	"github.com/cmars/onionpipe/secrets"
 	"github.com/cmars/onionpipe/tor"
 )
 
@@ -85,6 +91,115 @@ func TestApp(t *testing.T) {
 		_, err = os.Stat(home + "/.local/share/onionpipe/secrets.not-anonymous.json")
 		c.Assert(err, qt.IsNil)
 	})
+	c.Run("config file and limits", func(c *qt.C) {
+		home := c.Mkdir()
+		c.Setenv("HOME", home)
+		fwdSvc.fwds = nil
+		configPath := home + "/onionpipe.json"
+		err := os.WriteFile(configPath, []byte(`{"forwards": [{
+			"src": {"ports": [9090]},
+			"dest": {"ports": [80], "alias": "test"},
+			"limits": {"maxConns": 5}
+		}]}`), 0600)
+		c.Assert(err, qt.IsNil)
+		err = App().Run([]string{"onionpipe", "--config", configPath, "--idle-timeout", "1m", "--conn-rate", "64K", "8080",
+			"tcp://127.0.0.1:8081?dialTimeout=5s&idleTimeout=10s"})
+		c.Assert(err, qt.IsNil)
+
+		c.Assert(fwdSvc.fwds, qt.HasLen, 3)
+		c.Assert(fwdSvc.fwds[0].Description(fwdSvc.onions), qt.Equals, "127.0.0.1:9090 => abc.onion:80")
+		c.Assert(fwdSvc.fwds[0].Limits(), qt.Equals, config.Limits{MaxConns: 5})
+		c.Assert(fwdSvc.fwds[1].Description(fwdSvc.onions), qt.Equals, "127.0.0.1:8080 => xyz.onion:8080")
+		c.Assert(fwdSvc.fwds[1].Limits(), qt.Equals, config.Limits{IdleTimeout: time.Minute, ConnRate: 65536})
+		// Timeouts given as endpoint options override flags.
+		c.Assert(fwdSvc.fwds[2].Limits(), qt.Equals, config.Limits{DialTimeout: 5 * time.Second, IdleTimeout: 10 * time.Second, ConnRate: 65536})
+		_, err = os.Stat(defaultSecretsPath())
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("serve", func(c *qt.C) {
+		home := c.Mkdir()
+		c.Setenv("HOME", home)
+		fwdSvc.fwds = nil
+		err := App().Run([]string{"onionpipe", "serve", c.Mkdir() + "~80@test"})
+		c.Assert(err, qt.IsNil)
+
+		c.Assert(fwdSvc.fwds, qt.HasLen, 1)
+		c.Assert(fwdSvc.fwds[0].Source().IsUnix(), qt.IsTrue)
+		c.Assert(fwdSvc.fwds[0].Destination().Description(fwdSvc.onions), qt.Equals, "abc.onion:80")
+
+		err = App().Run([]string{"onionpipe", "serve", filepath.Join(home, "missing")})
+		c.Assert(err, qt.ErrorMatches, `stat .*missing: no such file or directory`)
+	})
+
+	c.Run("environment", func(c *qt.C) {
+		home := c.Mkdir()
+		c.Setenv("HOME", home)
+		c.Setenv("ONIONPIPE_FORWARDS", "${APP_PORT}@test  9090")
+		c.Setenv("APP_PORT", "8080")
+		c.Setenv("ONIONPIPE_MAX_CONNS", "3")
+		c.Setenv("ONIONPIPE_SECRETS", filepath.Join(home, "secrets.json"))
+		fwdSvc.fwds = nil
+		err := App().Run([]string{"onionpipe"})
+		c.Assert(err, qt.IsNil)
+
+		c.Assert(fwdSvc.fwds, qt.HasLen, 2)
+		c.Assert(fwdSvc.fwds[0].Description(fwdSvc.onions), qt.Equals, "127.0.0.1:8080 => abc.onion:8080")
+		c.Assert(fwdSvc.fwds[0].Limits(), qt.Equals, config.Limits{MaxConns: 3})
+		c.Assert(fwdSvc.fwds[1].Description(fwdSvc.onions), qt.Equals, "127.0.0.1:9090 => xyz.onion:9090")
+		_, err = os.Stat(filepath.Join(home, "secrets.json"))
+		c.Assert(err, qt.IsNil)
+	})
+
+	c.Run("per-import auth", func(c *qt.C) {
+		c.Setenv("HOME", c.Mkdir())
+		var conf tor.StartConf
+		c.Patch(&startTor, func(_ context.Context, options ...tor.Option) (*tor.Tor, error) {
+			for _, option := range options {
+				option(&conf)
+			}
+			return &tor.Tor{}, nil
+		})
+		for _, name := range []string{"work", "home"} {
+			err := App().Run([]string{"onionpipe", "client", "new", name})
+			c.Assert(err, qt.IsNil)
+		}
+		onionA, onionB := strings.Repeat("a", 56), strings.Repeat("b", 56)
+		err := App().Run([]string{"onionpipe", "--auth", "home",
+			"onion://" + onionA + ".onion:80?auth=work~8080",
+			onionB + ".onion:80~8081",
+			"onion://" + onionA + ".onion:443?auth=work~8443",
+		})
+		c.Assert(err, qt.IsNil)
+		sec, err := secrets.ReadFile(defaultSecretsPath())
+		c.Assert(err, qt.IsNil)
+		workKey, err := sec.ResolveClientPrivateKey("work")
+		c.Assert(err, qt.IsNil)
+		homeKey, err := sec.ResolveClientPrivateKey("home")
+		c.Assert(err, qt.IsNil)
+		c.Assert(conf.ClientAuths, qt.DeepEquals, []tor.ClientAuth{
+			{OnionID: onionA, PrivateKey: workKey},
+			{OnionID: onionB, PrivateKey: homeKey},
+		})
+
+		err = App().Run([]string{"onionpipe",
+			"onion://" + onionA + ".onion:80?auth=work~8080",
+			"onion://" + onionA + ".onion:443?auth=home~8443",
+		})
+		c.Assert(err, qt.ErrorMatches, `conflicting client authorization for a+\.onion`)
+	})
+
+	c.Run("invalid address family", func(c *qt.C) {
+		c.Setenv("HOME", c.Mkdir())
+		err := App().Run([]string{"onionpipe", "--address-family", "ipx", "8000~80"})
+		c.Assert(err, qt.ErrorMatches, `invalid address family "ipx"`)
+	})
+
+	c.Run("invalid isolation", func(c *qt.C) {
+		c.Setenv("HOME", c.Mkdir())
+		err := App().Run([]string{"onionpipe", "--isolation", "total", "xxx.onion:80~8080"})
+		c.Assert(err, qt.ErrorMatches, `invalid isolation "total"`)
+	})
 }
 
 type mockForwardingService struct {
@@ -101,3 +216,34 @@ func (*mockForwardingService) Done() <-chan struct{} {
 func (m *mockForwardingService) Start(ctx context.Context, options ...forwarding.Option) (map[string]string, error) {
 	return m.onions, nil
 }
+
+func (m *mockForwardingService) Status() []forwarding.ForwardStatus {
+	return nil
+}
+
+func (m *mockForwardingService) Reload(fwds []*config.Forward) {}
+
+func (m *mockForwardingService) WriteMetrics(w io.Writer) error {
+	_, err := io.WriteString(w, "onionpipe_uptime_seconds 1\n")
+	return err
+}
+
+func TestMetricsHandler(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewServer(metricsHandler(&mockForwardingService{}))
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), qt.Matches, `text/plain; version=0\.0\.4.*`)
+	body, err := io.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(body), qt.Equals, "onionpipe_uptime_seconds 1\n")
+
+	resp, err = srv.Client().Get(srv.URL + "/")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, 404)
+}
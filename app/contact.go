@@ -0,0 +1,74 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/cmars/onionpipe/secrets"
+)
+
+// ListContacts implements the `contact ls` command.
+func ListContacts(ctx *cli.Context) error {
+	if ctx.Args().Present() {
+		return cli.ShowSubcommandHelp(ctx)
+	}
+	sec, err := openSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	contacts := sec.Contacts
+	if contacts == nil {
+		contacts = map[string]secrets.Contact{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&contacts)
+}
+
+// AddContact implements the `contact add` command.
+func AddContact(ctx *cli.Context) error {
+	name, address := ctx.Args().Get(0), ctx.Args().Get(1)
+	if name == "" {
+		return fmt.Errorf("missing contact name")
+	}
+	if address == "" {
+		return fmt.Errorf("missing onion address")
+	}
+	sec, err := openSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	err = sec.AddContact(name, secrets.Contact{Address: address, Auth: ctx.String("auth")})
+	if err != nil {
+		return err
+	}
+	err = sec.WriteFile()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]secrets.Contact{
+		name: sec.Contacts[name],
+	})
+}
+
+// RemoveContact implements the `contact rm` command.
+func RemoveContact(ctx *cli.Context) error {
+	name := ctx.Args().Get(0)
+	if name == "" {
+		return fmt.Errorf("missing contact name")
+	}
+	sec, err := openSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	err = sec.RemoveContact(name)
+	if err != nil {
+		return err
+	}
+	return sec.WriteFile()
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/secrets"
+)
+
+func TestContactCommands(t *testing.T) {
+	c := qt.New(t)
+	home := c.Mkdir()
+	c.Setenv("HOME", home)
+	onionID := strings.Repeat("b", 56)
+
+	listContacts := func(c *qt.C) map[string]secrets.Contact {
+		in, out, err := os.Pipe()
+		c.Assert(err, qt.IsNil)
+		stdout := os.Stdout
+		os.Stdout = out
+		defer func() { os.Stdout = stdout }()
+		go func() {
+			defer out.Close()
+			err := App().Run([]string{"onionpipe", "contact"})
+			c.Assert(err, qt.IsNil)
+		}()
+		var contacts map[string]secrets.Contact
+		err = json.NewDecoder(in).Decode(&contacts)
+		c.Assert(err, qt.IsNil)
+		return contacts
+	}
+
+	c.Run("add/rm contacts", func(c *qt.C) {
+		c.Assert(listContacts(c), qt.HasLen, 0)
+		err := App().Run([]string{"onionpipe", "client", "new", "me"})
+		c.Assert(err, qt.IsNil)
+		err = App().Run([]string{"onionpipe", "contact", "add", "--auth", "me", "bob-wiki", onionID + ".onion"})
+		c.Assert(err, qt.IsNil)
+		err = App().Run([]string{"onionpipe", "contact", "add", "alice", onionID})
+		c.Assert(err, qt.IsNil)
+		err = App().Run([]string{"onionpipe", "contact", "add", "carol"})
+		c.Assert(err, qt.ErrorMatches, `missing onion address`)
+		err = App().Run([]string{"onionpipe", "contact", "rm", "alice"})
+		c.Assert(err, qt.IsNil)
+		c.Assert(listContacts(c), qt.DeepEquals, map[string]secrets.Contact{
+			"bob-wiki": {Address: onionID, Auth: "me"},
+		})
+	})
+
+	c.Run("import contact", func(c *qt.C) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, qt.IsNil)
+		port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+		l.Close()
+		output, err := runValidate(c, "onion://bob-wiki:80~"+port)
+		c.Assert(err, qt.IsNil)
+		c.Assert(output, qt.Equals, "ok: onion://"+onionID+".onion:80?auth=me~127.0.0.1:"+port+"\n")
+	})
+}
@@ -1,13 +1,17 @@
 package app
 
 import (
+	"bytes"
 	"context"
 	"encoding/base32"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 
@@ -28,18 +32,176 @@ var newForwardingService = func(t *tor.Tor, fwds ...*config.Forward) forwardingS
 type forwardingService interface {
 	Done() <-chan struct{}
 	Start(ctx context.Context, options ...forwarding.Option) (map[string]string, error)
+	Status() []forwarding.ForwardStatus
+	Reload(fwds []*config.Forward)
+	WriteMetrics(w io.Writer) error
 }
 
 // Forward sets up and operates onionpipe forwards.
-func Forward(ctx *cli.Context) (cmdErr error) {
+func Forward(ctx *cli.Context) error {
+	fwds, err := parseForwards(ctx)
+	if err != nil {
+		return err
+	}
+	logWarnings(fwds)
+	return runForwards(ctx, fwds, runOptions{})
+}
+
+// logWarnings logs the problems found parsing forwards which do not stop them
+// from operating.
+func logWarnings(fwds []*config.Forward) {
+	for _, fwd := range fwds {
+		for _, err := range fwd.Warnings() {
+			log.Printf("warning: %s: %v", fwd.Description(nil), err)
+		}
+	}
+}
+
+// parseForwards returns the forwards read from the configuration file and
+// given as arguments, with the options given by flags applied.
+func parseForwards(ctx *cli.Context) ([]*config.Forward, error) {
 	var fwds []*config.Forward
-	var sec *secrets.Secrets
 	var err error
-	for i := 0; i < ctx.Args().Len(); i++ {
-		fwd, err := config.ParseForward(ctx.Args().Get(i))
+	if configPath := ctx.Path("config"); configPath != "" {
+		fwds, err = config.ReadFile(configPath)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	p, err := newForwardParser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, arg := range forwardArgs(ctx) {
+		fwd, err := p.parse(arg)
+		if err != nil {
+			return nil, err
+		}
+		fwds = append(fwds, fwd)
+	}
+	return fwds, nil
+}
+
+// forwardParser parses forwards given as arguments, applying the options
+// given by flags.
+type forwardParser struct {
+	options       []config.ParseOption
+	limits        config.Limits
+	accessLog     config.AccessLog
+	retryDeadline time.Duration
+	prewarm       bool
+	isolation     config.Isolation
+	localTLS      *config.LocalTLS
+	remoteTLS     *config.RemoteTLS
+}
+
+// newForwardParser returns a parser of forward arguments, with the options
+// given by flags.
+func newForwardParser(ctx *cli.Context) (*forwardParser, error) {
+	p := &forwardParser{prewarm: ctx.Bool("prewarm")}
+	var err error
+	p.limits, err = limitsFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.retryDeadline = ctx.Duration("dial-retry")
+	if p.retryDeadline < 0 {
+		return nil, fmt.Errorf("dial retry must not be negative")
+	}
+	p.isolation, err = config.ParseIsolation(ctx.String("isolation"))
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Bool("local-tls") {
+		p.localTLS, err = config.NewLocalTLS(ctx.Path("tls-cert"), ctx.Path("tls-key"))
+		if err != nil {
+			return nil, fmt.Errorf("local TLS: %w", err)
+		}
+	} else if ctx.Path("tls-cert") != "" || ctx.Path("tls-key") != "" {
+		return nil, fmt.Errorf("--tls-cert and --tls-key require --local-tls")
+	}
+	if fingerprint, caFile := ctx.String("remote-tls-fingerprint"), ctx.Path("remote-tls-ca"); fingerprint != "" || caFile != "" {
+		p.remoteTLS, err = config.NewRemoteTLS(ctx.String("remote-tls-server-name"), fingerprint, caFile)
+		if err != nil {
+			return nil, fmt.Errorf("remote TLS: %w", err)
 		}
+	} else if ctx.String("remote-tls-server-name") != "" {
+		return nil, fmt.Errorf("--remote-tls-server-name requires --remote-tls-fingerprint or --remote-tls-ca")
+	}
+	p.accessLog, err = accessLogFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	family, err := config.ParseAddressFamily(ctx.String("address-family"))
+	if err != nil {
+		return nil, err
+	}
+	resolution, err := config.ParseResolution(ctx.String("resolve"))
+	if err != nil {
+		return nil, err
+	}
+	sec, err := readSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.options = []config.ParseOption{
+		config.PreferAddressFamily(family),
+		config.ResolveSource(resolution),
+		config.LookupContacts(sec.LookupContact),
+	}
+	return p, nil
+}
+
+// parse parses a forward argument.
+func (p *forwardParser) parse(arg string) (*config.Forward, error) {
+	fwd, err := config.ParseForward(arg, p.options...)
+	if err != nil {
+		return nil, err
+	}
+	// Options given on a forward's endpoints are more specific than flags.
+	fwd.SetLimits(p.limits.Merge(fwd.Limits()))
+	fwd.SetAccessLog(p.accessLog)
+	if fwd.IsImport() {
+		fwd.SetRetry(config.NewRetry(p.retryDeadline))
+		fwd.SetPrewarm(p.prewarm)
+		fwd.SetIsolation(p.isolation)
+		fwd.SetLocalTLS(p.localTLS)
+		fwd.SetRemoteTLS(p.remoteTLS)
+	}
+	return fwd, nil
+}
+
+// forwardArgs returns the forward expressions given as arguments, followed by
+// those given as whitespace-separated expressions by --forwards.
+func forwardArgs(ctx *cli.Context) []string {
+	return append(ctx.Args().Slice(), strings.Fields(ctx.String("forwards"))...)
+}
+
+// checkClientPublicKey checks a client public key given to --require-auth,
+// which must be base32 encoded.
+func checkClientPublicKey(key string) error {
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(key)); err != nil {
+		return fmt.Errorf("invalid client auth %q: %w", key, err)
+	}
+	return nil
+}
+
+// runOptions are options set by the commands which forward, in addition to
+// those given by flags.
+type runOptions struct {
+	// requireAuth are client public keys authorized to use exports.
+	requireAuth []string
+	// started is called once forwards are operating, with the assigned
+	// onion IDs.
+	started func(onionIDs map[string]string)
+}
+
+// runForwards operates forwards until interrupted, with the options common to
+// the commands which forward.
+func runForwards(ctx *cli.Context, fwds []*config.Forward, opts runOptions) error {
+	var sec *secrets.Secrets
+	var err error
+	for _, fwd := range fwds {
 		if fwd.Destination().Alias() != "" {
 			if sec == nil {
 				sec, err = openSecrets(ctx)
@@ -53,14 +215,13 @@ func Forward(ctx *cli.Context) (cmdErr error) {
 			}
 			fwd.Destination().SetServiceKey(privkey)
 		}
-		fwds = append(fwds, fwd)
 	}
 	// If we added any service keys, persist them now.
 	if sec != nil {
 		if err := sec.WriteFile(); err != nil {
 			return err
 		}
-	} else if ctx.String("auth") != "" {
+	} else if needsClientAuth(ctx, fwds) {
 		// Open secrets if we haven't already, used to resolve clients below
 		sec, err = openSecrets(ctx)
 		if err != nil {
@@ -68,15 +229,12 @@ func Forward(ctx *cli.Context) (cmdErr error) {
 		}
 	}
 
-	var requireAuth []string
-	if authValues := ctx.StringSlice("require-auth"); len(authValues) > 0 {
-		for _, v := range authValues {
-			_, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(v))
-			if err != nil {
-				return fmt.Errorf("invalid client auth %q: %w", v, err)
-			}
-			requireAuth = append(requireAuth, v)
+	requireAuth := opts.requireAuth
+	for _, v := range ctx.StringSlice("require-auth") {
+		if err := checkClientPublicKey(v); err != nil {
+			return err
 		}
+		requireAuth = append(requireAuth, v)
 	}
 
 	fwdCtx, cancel := signal.NotifyContext(ctx.Context, os.Interrupt)
@@ -91,26 +249,31 @@ func Forward(ctx *cli.Context) (cmdErr error) {
 		torOptions = append(torOptions, tor.NonAnonymous)
 		fwdOptions = append(fwdOptions, forwarding.NonAnonymous)
 	}
-	if useAuth := ctx.String("auth"); useAuth != "" {
-		key, err := sec.ResolveClientPrivateKey(useAuth)
+	if sec != nil {
+		clientAuths, err := importClientAuths(ctx, sec, fwds)
 		if err != nil {
 			return err
 		}
-		var clientAuths []tor.ClientAuth
-		for _, fwd := range fwds {
-			if onionID, ok := fwd.Source().OnionID(); ok {
-				clientAuths = append(clientAuths, tor.ClientAuth{
-					OnionID:    onionID,
-					PrivateKey: key,
-				})
-			}
+		if len(clientAuths) > 0 {
+			torOptions = append(torOptions, tor.ClientAuths(clientAuths...))
 		}
-		torOptions = append(torOptions, tor.ClientAuths(clientAuths...))
 	}
 	if len(requireAuth) > 0 {
 		fwdOptions = append(fwdOptions, forwarding.AuthClients(requireAuth))
 	}
 
+	var metricsListener net.Listener
+	if addr := ctx.String("metrics-listen"); addr != "" {
+		// Listen before starting, so that the address being in use is an
+		// error up front.
+		metricsListener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+		defer metricsListener.Close()
+		fwdOptions = append(fwdOptions, forwarding.CollectMetrics)
+	}
+
 	var stopped bool
 	log.Println("starting tor...")
 	t, err := startTor(nil, torOptions...)
@@ -135,17 +298,192 @@ func Forward(ctx *cli.Context) (cmdErr error) {
 	for _, fwd := range fwds {
 		fmt.Println(fwd.Description(onionIDs))
 	}
+	if opts.started != nil {
+		opts.started(onionIDs)
+	}
+	if metricsListener != nil {
+		log.Printf("serving metrics on http://%s/metrics", metricsListener.Addr())
+		go serveMetrics(metricsListener, svc)
+	}
 
 	fmt.Println()
 	fmt.Println("press Ctrl-C to exit")
-	select {
-	case <-svc.Done():
-		log.Println("shutting down tor...")
-		if err := t.Close(); err != nil {
-			log.Println(err)
+	sigs := make(chan os.Signal, 1)
+	if reloadSignal != nil {
+		signal.Notify(sigs, reloadSignal, statusSignal)
+		defer signal.Stop(sigs)
+	}
+	for !stopped {
+		select {
+		case <-svc.Done():
+			log.Println("shutting down tor...")
+			if err := t.Close(); err != nil {
+				log.Println(err)
+			}
+			stopped = true
+		case sig := <-sigs:
+			if sig == reloadSignal {
+				reloadConfig(ctx, svc)
+			}
+			logStatus(svc)
 		}
-		stopped = true
 	}
 	log.Println("shutdown complete")
 	return nil
 }
+
+// importAuth returns the client authorization with which an import connects
+// to its onion: the import's own, or that given by --auth.
+func importAuth(ctx *cli.Context, fwd *config.Forward) string {
+	if auth := fwd.Source().Auth(); auth != "" {
+		return auth
+	}
+	return ctx.String("auth")
+}
+
+// needsClientAuth returns whether any imports connect with client
+// authorization.
+func needsClientAuth(ctx *cli.Context, fwds []*config.Forward) bool {
+	for _, fwd := range fwds {
+		if fwd.IsImport() && importAuth(ctx, fwd) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// importClientAuths returns the client authorizations of imports, one per
+// imported onion.
+func importClientAuths(ctx *cli.Context, sec *secrets.Secrets, fwds []*config.Forward) ([]tor.ClientAuth, error) {
+	var clientAuths []tor.ClientAuth
+	keys := newClientKeys(sec)
+	for _, fwd := range fwds {
+		onionID, ok := fwd.Source().OnionID()
+		auth := importAuth(ctx, fwd)
+		if !ok || auth == "" {
+			continue
+		}
+		key, first, err := keys.add(onionID, auth)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			clientAuths = append(clientAuths, tor.ClientAuth{
+				OnionID:    onionID,
+				PrivateKey: key,
+			})
+		}
+	}
+	return clientAuths, nil
+}
+
+// clientKeys collects the client private keys with which onions are
+// imported. Tor authorizes with one key per onion, so every import of an
+// onion must resolve to the same key.
+type clientKeys struct {
+	sec  *secrets.Secrets
+	keys map[string][]byte
+}
+
+func newClientKeys(sec *secrets.Secrets) *clientKeys {
+	return &clientKeys{sec: sec, keys: map[string][]byte{}}
+}
+
+// add resolves the client authorization of an import of an onion to a
+// private key, returning the key and whether it is the first for the onion.
+func (k *clientKeys) add(onionID, auth string) ([]byte, bool, error) {
+	key, err := k.sec.ResolveClientPrivateKey(auth)
+	if err != nil {
+		return nil, false, err
+	}
+	if prev, ok := k.keys[onionID]; ok {
+		if !bytes.Equal(prev, key) {
+			return nil, false, fmt.Errorf("conflicting client authorization for %s.onion", onionID)
+		}
+		return key, false, nil
+	}
+	k.keys[onionID] = key
+	return key, true, nil
+}
+
+// reloadConfig applies changes in the configuration file to running forwards.
+func reloadConfig(ctx *cli.Context, svc forwardingService) {
+	configPath := ctx.Path("config")
+	if configPath == "" {
+		log.Println("reload: no configuration file")
+		return
+	}
+	fwds, err := config.ReadFile(configPath)
+	if err != nil {
+		log.Printf("reload: %v", err)
+		return
+	}
+	logWarnings(fwds)
+	svc.Reload(fwds)
+}
+
+func logStatus(svc forwardingService) {
+	for _, st := range svc.Status() {
+		if !st.Relayed {
+			log.Printf("status: %s: not relayed", st.Forward)
+			continue
+		}
+		log.Printf("status: %s: %d active, %d rejected, rate %s, connection rate %s",
+			st.Forward, st.ActiveConns, st.Rejected, formatRate(st.Rate), formatRate(st.ConnRate))
+	}
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d bytes/s", rate)
+}
+
+func limitsFlags(ctx *cli.Context) (config.Limits, error) {
+	limits := config.Limits{
+		MaxConns:    ctx.Int("max-conns"),
+		IdleTimeout: ctx.Duration("idle-timeout"),
+		MaxLifetime: ctx.Duration("max-lifetime"),
+		DialTimeout: ctx.Duration("dial-timeout"),
+	}
+	if limits.MaxConns < 0 || limits.IdleTimeout < 0 || limits.MaxLifetime < 0 || limits.DialTimeout < 0 {
+		return config.Limits{}, fmt.Errorf("connection limits must not be negative")
+	}
+	var err error
+	if rate := ctx.String("rate"); rate != "" {
+		limits.Rate, err = config.ParseBytes(rate)
+		if err != nil {
+			return config.Limits{}, fmt.Errorf("invalid rate: %w", err)
+		}
+	}
+	if connRate := ctx.String("conn-rate"); connRate != "" {
+		limits.ConnRate, err = config.ParseBytes(connRate)
+		if err != nil {
+			return config.Limits{}, fmt.Errorf("invalid conn-rate: %w", err)
+		}
+	}
+	return limits, nil
+}
+
+func accessLogFlags(ctx *cli.Context) (config.AccessLog, error) {
+	file := ctx.String("access-log")
+	if file == "" {
+		if ctx.IsSet("access-log-format") || ctx.IsSet("access-log-max-size") {
+			return config.AccessLog{}, fmt.Errorf("access log options require --access-log")
+		}
+		return config.AccessLog{}, nil
+	}
+	if file == "-" {
+		file = ""
+	}
+	var maxSize int64
+	if s := ctx.String("access-log-max-size"); s != "" {
+		var err error
+		maxSize, err = config.ParseBytes(s)
+		if err != nil {
+			return config.AccessLog{}, fmt.Errorf("invalid access-log-max-size: %w", err)
+		}
+	}
+	return config.NewAccessLog(ctx.String("access-log-format"), file, maxSize)
+}
@@ -0,0 +1,28 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// metricsHandler serves the forwarding service's metrics to Prometheus.
+func metricsHandler(svc forwardingService) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := svc.WriteMetrics(w); err != nil {
+			log.Printf("failed to write metrics: %v", err)
+		}
+	})
+	return mux
+}
+
+// serveMetrics serves metrics on the listener until it is closed.
+func serveMetrics(l net.Listener, svc forwardingService) {
+	err := http.Serve(l, metricsHandler(svc))
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("failed to serve metrics: %v", err)
+	}
+}
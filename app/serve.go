@@ -0,0 +1,151 @@
+package app
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/cmars/onionpipe/config"
+	"github.com/cmars/onionpipe/forwarding"
+)
+
+// serveFlags returns the flags of the serve command.
+func serveFlags() []cli.Flag {
+	return append(commonFlags(),
+		&cli.BoolFlag{
+			Name:  "listing",
+			Usage: "list the contents of directories without an index.html",
+		},
+		&cli.StringFlag{
+			Name:    "basic-auth",
+			Usage:   "require HTTP basic auth with this user:password",
+			EnvVars: []string{"ONIONPIPE_BASIC_AUTH"},
+		},
+	)
+}
+
+// Serve shares local directories as onion services, with a built-in HTTP
+// file server for each.
+func Serve(ctx *cli.Context) error {
+	if ctx.Args().Len() == 0 {
+		return fmt.Errorf("missing directory to serve")
+	}
+	var user, password string
+	if basicAuth := ctx.String("basic-auth"); basicAuth != "" {
+		var ok bool
+		user, password, ok = strings.Cut(basicAuth, ":")
+		if !ok || user == "" || password == "" {
+			return fmt.Errorf("basic auth must be given as user:password")
+		}
+	}
+
+	// File servers listen on private UNIX sockets, which are exported like
+	// any other local socket.
+	runDir, err := os.MkdirTemp("", "onionpipe-serve-")
+	if err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	defer os.RemoveAll(runDir)
+
+	var fwds []*config.Forward
+	for i, arg := range ctx.Args().Slice() {
+		dir, dest := arg, "80"
+		if i := strings.LastIndex(arg, "~"); i >= 0 {
+			dir, dest = arg[:i], arg[i+1:]
+		}
+		if st, err := os.Stat(dir); err != nil {
+			return err
+		} else if !st.IsDir() {
+			return fmt.Errorf("not a directory: %s", dir)
+		}
+		sock := filepath.Join(runDir, fmt.Sprintf("serve%d.sock", i+1))
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %q: %w", sock, err)
+		}
+		srv := &http.Server{
+			Handler:           fileServer(dir, ctx.Bool("listing"), user, password),
+			ReadHeaderTimeout: forwarding.ReadHeaderTimeout,
+			IdleTimeout:       forwarding.IdleTimeout,
+		}
+		go func() {
+			if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("serve %s: %v", dir, err)
+			}
+		}()
+		defer srv.Close()
+
+		fwd, err := config.ParseForward(sock + "~" + dest)
+		if err != nil {
+			return err
+		}
+		if fwd.IsImport() {
+			return fmt.Errorf("invalid destination %q", dest)
+		}
+		log.Printf("serving %s on %s", dir, sock)
+		fwds = append(fwds, fwd)
+	}
+	return runForwards(ctx, fwds, runOptions{})
+}
+
+// fileServer returns a handler which serves files in a directory, with
+// support for range requests. Directories without an index.html are only
+// listed if enabled. If a user is given, HTTP basic auth is required.
+func fileServer(dir string, listing bool, user, password string) http.Handler {
+	var fs http.FileSystem = http.Dir(dir)
+	if !listing {
+		fs = noListingFS{fs}
+	}
+	h := http.FileServer(fs)
+	if user == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="onionpipe"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// noListingFS hides directories which do not have an index.html, so that
+// their contents are not listed.
+type noListingFS struct {
+	http.FileSystem
+}
+
+// Open implements http.FileSystem.
+func (fs noListingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
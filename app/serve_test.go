@@ -0,0 +1,79 @@
+package app
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFileServer(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello world"), 0644), qt.IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "site"), 0755), qt.IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "site", "index.html"), []byte("<h1>hi</h1>"), 0644), qt.IsNil)
+
+	get := func(c *qt.C, h http.Handler, path string, setup func(*http.Request)) (int, string) {
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+		req, err := http.NewRequest("GET", srv.URL+path, nil)
+		c.Assert(err, qt.IsNil)
+		if setup != nil {
+			setup(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		c.Assert(err, qt.IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	c.Run("file", func(c *qt.C) {
+		status, body := get(c, fileServer(dir, false, "", ""), "/hello.txt", nil)
+		c.Assert(status, qt.Equals, http.StatusOK)
+		c.Assert(body, qt.Equals, "hello world")
+	})
+
+	c.Run("range", func(c *qt.C) {
+		status, body := get(c, fileServer(dir, false, "", ""), "/hello.txt", func(req *http.Request) {
+			req.Header.Set("Range", "bytes=6-")
+		})
+		c.Assert(status, qt.Equals, http.StatusPartialContent)
+		c.Assert(body, qt.Equals, "world")
+	})
+
+	c.Run("no listing", func(c *qt.C) {
+		status, _ := get(c, fileServer(dir, false, "", ""), "/", nil)
+		c.Assert(status, qt.Equals, http.StatusNotFound)
+		status, body := get(c, fileServer(dir, false, "", ""), "/site/", nil)
+		c.Assert(status, qt.Equals, http.StatusOK)
+		c.Assert(body, qt.Equals, "<h1>hi</h1>")
+	})
+
+	c.Run("listing", func(c *qt.C) {
+		status, body := get(c, fileServer(dir, true, "", ""), "/", nil)
+		c.Assert(status, qt.Equals, http.StatusOK)
+		c.Assert(body, qt.Contains, "hello.txt")
+	})
+
+	c.Run("basic auth", func(c *qt.C) {
+		h := fileServer(dir, false, "alice", "s3cret")
+		status, _ := get(c, h, "/hello.txt", nil)
+		c.Assert(status, qt.Equals, http.StatusUnauthorized)
+		status, _ = get(c, h, "/hello.txt", func(req *http.Request) {
+			req.SetBasicAuth("alice", "wrong")
+		})
+		c.Assert(status, qt.Equals, http.StatusUnauthorized)
+		status, body := get(c, h, "/hello.txt", func(req *http.Request) {
+			req.SetBasicAuth("alice", "s3cret")
+		})
+		c.Assert(status, qt.Equals, http.StatusOK)
+		c.Assert(body, qt.Equals, "hello world")
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package app
+
+import "os"
+
+// reloadSignal is not supported on this platform.
+var reloadSignal os.Signal
+
+// statusSignal is not supported on this platform.
+var statusSignal os.Signal
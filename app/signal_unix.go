@@ -0,0 +1,14 @@
+//go:build linux || darwin
+
+package app
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignal reloads the configuration file of a running forward.
+var reloadSignal os.Signal = syscall.SIGHUP
+
+// statusSignal logs the runtime status of a running forward.
+var statusSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,452 @@
+package app
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/cmars/onionpipe/config"
+	"github.com/cmars/onionpipe/tor"
+)
+
+// sendFlags returns the flags of the send command.
+func sendFlags() []cli.Flag {
+	return []cli.Flag{debugFlag(), anonymousFlag()}
+}
+
+// receiveFlags returns the flags of the receive command.
+func receiveFlags() []cli.Flag {
+	return []cli.Flag{
+		debugFlag(),
+		&cli.PathFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "write the file or directory here, rather than under its own name in the current directory",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "give up connecting to the sender after this long",
+			Value: 3 * time.Minute,
+		},
+	}
+}
+
+// transferAck is sent by the receiver once it has verified a transfer, before
+// writing it out.
+const transferAck = "ok\n"
+
+// share describes a file transfer offered by a sender. Its string form is
+// given to the receiver out of band.
+type share struct {
+	onionID string
+	name    string
+	key     []byte
+	digest  []byte
+	size    int64
+	dir     bool
+}
+
+var base32Key = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// String returns the share string given to the receiver.
+func (s *share) String() string {
+	q := url.Values{}
+	q.Set("key", strings.ToLower(base32Key.EncodeToString(s.key)))
+	q.Set("sha256", hex.EncodeToString(s.digest))
+	q.Set("size", strconv.FormatInt(s.size, 10))
+	if s.dir {
+		q.Set("dir", "1")
+	}
+	u := url.URL{
+		Scheme:   "onionpipe",
+		Host:     s.onionID + ".onion",
+		Path:     "/" + s.name,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// parseShare parses a share string.
+func parseShare(str string) (*share, error) {
+	u, err := url.Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid share: %w", err)
+	}
+	if u.Scheme != "onionpipe" || !config.IsOnionHost(u.Host) {
+		return nil, fmt.Errorf("invalid share: not an onionpipe share")
+	}
+	s := &share{
+		onionID: strings.TrimSuffix(u.Host, ".onion"),
+		name:    strings.TrimPrefix(u.Path, "/"),
+		dir:     u.Query().Get("dir") == "1",
+	}
+	if s.name == "" || !filepath.IsLocal(s.name) || strings.ContainsAny(s.name, `/\`) {
+		return nil, fmt.Errorf("invalid share: invalid name %q", s.name)
+	}
+	q := u.Query()
+	s.key, err = base32Key.DecodeString(strings.ToUpper(q.Get("key")))
+	if err != nil || len(s.key) != 32 {
+		return nil, fmt.Errorf("invalid share: invalid key")
+	}
+	s.digest, err = hex.DecodeString(q.Get("sha256"))
+	if err != nil || len(s.digest) != sha256.Size {
+		return nil, fmt.Errorf("invalid share: invalid sha256")
+	}
+	s.size, err = strconv.ParseInt(q.Get("size"), 10, 64)
+	if err != nil || s.size < 0 {
+		return nil, fmt.Errorf("invalid share: invalid size")
+	}
+	return s, nil
+}
+
+// Send offers a file or directory to a single receiver, through an ephemeral
+// onion which only the receiver is authorized to use. It shuts down once the
+// receiver has verified the transfer.
+func Send(ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return fmt.Errorf("missing file to send")
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	runDir, err := os.MkdirTemp("", "onionpipe-send-")
+	if err != nil {
+		return fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	defer os.RemoveAll(runDir)
+
+	sh := &share{name: filepath.Base(filepath.Clean(path))}
+	payload := path
+	if st.IsDir() {
+		// Directories are sent as a tar, which is prepared up front so that
+		// its digest is known.
+		sh.dir = true
+		payload = filepath.Join(runDir, "payload.tar")
+		if err := writeTar(payload, path); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", path, err)
+		}
+	}
+	sh.digest, sh.size, err = digestFile(payload)
+	if err != nil {
+		return err
+	}
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sh.key = priv[:]
+
+	sock := filepath.Join(runDir, "send.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %w", sock, err)
+	}
+	sendCtx, cancel := context.WithCancel(ctx.Context)
+	defer cancel()
+	go func() {
+		defer cancel()
+		if err := sendOnce(sendCtx, l, payload); err != nil {
+			log.Printf("send: %v", err)
+			return
+		}
+		log.Printf("sent %s", path)
+	}()
+
+	fwd, err := config.ParseForward(sock + "~80")
+	if err != nil {
+		return err
+	}
+	ctx.Context = sendCtx
+	return runForwards(ctx, []*config.Forward{fwd}, runOptions{
+		requireAuth: []string{strings.ToLower(base32Key.EncodeToString(pub[:]))},
+		started: func(onionIDs map[string]string) {
+			sh.onionID = onionIDs[""]
+			fmt.Println()
+			fmt.Println("to receive, run:")
+			fmt.Println()
+			fmt.Printf("onionpipe receive '%s'\n", sh)
+		},
+	})
+}
+
+// sendOnce serves the payload on the listener until a receiver acknowledges
+// it, or the context is done.
+func sendOnce(ctx context.Context, l net.Listener, payload string) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		err = sendPayload(conn, payload)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+		log.Printf("send: transfer failed, waiting for the receiver to try again: %v", err)
+	}
+}
+
+func sendPayload(conn net.Conn, payload string) error {
+	f, err := os.Open(payload)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(conn, f); err != nil {
+		return err
+	}
+	ack := make([]byte, len(transferAck))
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no acknowledgement: %w", err)
+	}
+	if string(ack) != transferAck {
+		return fmt.Errorf("unexpected acknowledgement %q", ack)
+	}
+	return nil
+}
+
+// Receive imports a file or directory offered by a sender, verifying it
+// before writing it.
+func Receive(ctx *cli.Context) error {
+	sh, err := parseShare(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	output := ctx.Path("output")
+	if output == "" {
+		output = sh.name
+	}
+	if _, err := os.Lstat(output); err == nil {
+		return fmt.Errorf("%s already exists", output)
+	}
+
+	var torOptions []tor.Option
+	if ctx.Bool("debug") {
+		torOptions = append(torOptions, tor.Debug(os.Stderr))
+	}
+	torOptions = append(torOptions, tor.ClientAuths(tor.ClientAuth{OnionID: sh.onionID, PrivateKey: sh.key}))
+	log.Println("starting tor...")
+	t, err := startTor(nil, torOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to start tor: %v", err)
+	}
+	defer t.Close()
+	dialCtx, cancel := context.WithTimeout(ctx.Context, ctx.Duration("timeout"))
+	defer cancel()
+	dialer, err := t.Dialer(dialCtx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create tor network dialer: %w", err)
+	}
+
+	// The sender's onion descriptor may take a while to become available.
+	retry := config.NewRetry(ctx.Duration("timeout"))
+	var conn net.Conn
+	for i := 0; ; i++ {
+		conn, err = dialer.DialContext(dialCtx, "tcp", sh.onionID+".onion:80")
+		if err == nil {
+			break
+		}
+		if dialCtx.Err() != nil {
+			return fmt.Errorf("failed to connect to sender: %w", err)
+		}
+		log.Printf("failed to connect to sender, retrying: %v", err)
+		select {
+		case <-dialCtx.Done():
+		case <-time.After(retry.Backoff(i)):
+		}
+	}
+	defer conn.Close()
+	log.Printf("receiving %s (%d bytes)", sh.name, sh.size)
+	if err := receivePayload(conn, sh, output); err != nil {
+		return err
+	}
+	fmt.Println(output)
+	return nil
+}
+
+// receivePayload receives a payload from the sender, verifies it,
+// acknowledges it to the sender and writes it to the output path.
+func receivePayload(conn net.Conn, sh *share, output string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(output), ".onionpipe-receive-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(conn, sh.size))
+	if err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
+	if n != sh.size {
+		return fmt.Errorf("transfer failed: received %d of %d bytes", n, sh.size)
+	}
+	if !bytes.Equal(h.Sum(nil), sh.digest) {
+		return fmt.Errorf("transfer failed: sha256 digest does not match")
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Acknowledge once verified, before extracting, which may take longer
+	// than the sender waits. Failing to write the output is not something
+	// the sender can help with.
+	if _, err := conn.Write([]byte(transferAck)); err != nil {
+		return err
+	}
+	if sh.dir {
+		return extractTar(tmp.Name(), output)
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+func digestFile(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// writeTar archives the regular files and directories under dir. Other file
+// types are skipped.
+func writeTar(path, dir string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	tw := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			log.Printf("send: skipping %s, not a regular file or directory", p)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extractTar extracts the regular files and directories in a tar into a new
+// directory. Entries which would be written outside of it are refused.
+func extractTar(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("refusing to extract %q outside of %s", hdr.Name, dir)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			log.Printf("receive: skipping %s, not a regular file or directory", hdr.Name)
+		}
+	}
+}
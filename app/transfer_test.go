@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShare(t *testing.T) {
+	c := qt.New(t)
+	digest := sha256.Sum256([]byte("hello"))
+	sh := &share{
+		onionID: "abc",
+		name:    "hello world.txt",
+		key:     make([]byte, 32),
+		digest:  digest[:],
+		size:    5,
+	}
+	parsed, err := parseShare(sh.String())
+	c.Assert(err, qt.IsNil)
+	c.Assert(parsed, qt.CmpEquals(cmp.AllowUnexported(share{})), sh)
+
+	badName, badKey := *sh, *sh
+	badName.name = ".."
+	badKey.key = []byte("short")
+	for _, bad := range []string{
+		"https://abc.onion/hello.txt",
+		badName.String(),
+		badKey.String(),
+	} {
+		_, err := parseShare(bad)
+		c.Check(err, qt.ErrorMatches, "invalid share: .*", qt.Commentf("%s", bad))
+	}
+}
+
+// transfer sends a payload to a receiver over a local socket, returning the
+// receiver's error.
+func transfer(c *qt.C, payload string, sh *share, output string) error {
+	l, err := net.Listen("unix", filepath.Join(c.Mkdir(), "send.sock"))
+	c.Assert(err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan error, 1)
+	go func() { sent <- sendOnce(ctx, l, payload) }()
+
+	conn, err := net.Dial("unix", l.Addr().String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	err = receivePayload(conn, sh, output)
+	if err == nil {
+		c.Assert(<-sent, qt.IsNil)
+	}
+	return err
+}
+
+func TestTransfer(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("file", func(c *qt.C) {
+		payload := filepath.Join(c.Mkdir(), "hello.txt")
+		c.Assert(os.WriteFile(payload, []byte("hello world"), 0644), qt.IsNil)
+		sh := &share{name: "hello.txt"}
+		var err error
+		sh.digest, sh.size, err = digestFile(payload)
+		c.Assert(err, qt.IsNil)
+
+		output := filepath.Join(c.Mkdir(), "received.txt")
+		c.Assert(transfer(c, payload, sh, output), qt.IsNil)
+		contents, err := os.ReadFile(output)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(contents), qt.Equals, "hello world")
+	})
+
+	c.Run("directory", func(c *qt.C) {
+		src := c.Mkdir()
+		c.Assert(os.MkdirAll(filepath.Join(src, "a", "b"), 0755), qt.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(src, "a", "b", "c.txt"), []byte("deep"), 0644), qt.IsNil)
+		c.Assert(os.WriteFile(filepath.Join(src, "top.txt"), []byte("top"), 0644), qt.IsNil)
+		payload := filepath.Join(c.Mkdir(), "payload.tar")
+		c.Assert(writeTar(payload, src), qt.IsNil)
+		sh := &share{name: "src", dir: true}
+		var err error
+		sh.digest, sh.size, err = digestFile(payload)
+		c.Assert(err, qt.IsNil)
+
+		output := filepath.Join(c.Mkdir(), "received")
+		c.Assert(transfer(c, payload, sh, output), qt.IsNil)
+		contents, err := os.ReadFile(filepath.Join(output, "a", "b", "c.txt"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(contents), qt.Equals, "deep")
+		contents, err = os.ReadFile(filepath.Join(output, "top.txt"))
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(contents), qt.Equals, "top")
+	})
+
+	c.Run("digest mismatch", func(c *qt.C) {
+		payload := filepath.Join(c.Mkdir(), "hello.txt")
+		c.Assert(os.WriteFile(payload, []byte("hello world"), 0644), qt.IsNil)
+		digest := sha256.Sum256([]byte("something else"))
+		sh := &share{name: "hello.txt", digest: digest[:], size: 11}
+
+		output := filepath.Join(c.Mkdir(), "received.txt")
+		err := transfer(c, payload, sh, output)
+		c.Assert(err, qt.ErrorMatches, "transfer failed: sha256 digest does not match")
+		_, err = os.Stat(output)
+		c.Assert(os.IsNotExist(err), qt.IsTrue)
+	})
+}
@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/cmars/onionpipe/config"
+	"github.com/cmars/onionpipe/secrets"
+)
+
+// defaultValidateTimeout is how long validate waits to connect to backends,
+// unless --dial-timeout is given.
+const defaultValidateTimeout = 5 * time.Second
+
+// Validate implements the `validate` command, which checks forwards given as
+// they would be to `forward`, without starting Tor. Problems which would stop
+// forwards from operating are errors, and make the command fail. Aliases
+// without service keys are only warnings, as forwarding creates them. Each
+// forward argument is checked, even if others are invalid.
+func Validate(ctx *cli.Context) error {
+	configPath, args := ctx.Path("config"), forwardArgs(ctx)
+	if configPath == "" && len(args) == 0 {
+		return fmt.Errorf("no forwards to validate")
+	}
+	p, err := newForwardParser(ctx)
+	if err != nil {
+		return err
+	}
+	sec, err := readSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	v := &validator{sec: sec, timeout: defaultValidateTimeout, keys: newClientKeys(sec)}
+	if timeout := ctx.Duration("dial-timeout"); timeout > 0 {
+		v.timeout = timeout
+	}
+
+	var errs int
+	for _, key := range ctx.StringSlice("require-auth") {
+		if err := checkClientPublicKey(key); err != nil {
+			fmt.Printf("%s: %v\n", severityError, err)
+			errs++
+		}
+	}
+	var fwds []*config.Forward
+	if configPath != "" {
+		fwds, err = config.ReadFile(configPath)
+		if err != nil {
+			fmt.Printf("%s: %s: %v\n", severityError, configPath, err)
+			errs++
+		}
+	}
+	for _, arg := range args {
+		fwd, err := p.parse(arg)
+		if err != nil {
+			fmt.Printf("%s: %s: %v\n", severityError, arg, err)
+			errs++
+			continue
+		}
+		fwds = append(fwds, fwd)
+	}
+	for _, fwd := range fwds {
+		problems := v.check(ctx.Context, fwd, importAuth(ctx, fwd))
+		ok := true
+		for _, p := range problems {
+			fmt.Printf("%s: %s: %v\n", p.severity, fwd, p.err)
+			if p.severity == severityError {
+				ok = false
+				errs++
+			}
+		}
+		if ok {
+			fmt.Printf("ok: %s\n", fwd)
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("%d problem(s) found", errs)
+	}
+	return nil
+}
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// problem is something wrong with a forward found by validation.
+type problem struct {
+	severity string
+	err      error
+}
+
+// validator checks forwards against the local network and secrets store.
+type validator struct {
+	sec     *secrets.Secrets
+	timeout time.Duration
+	// keys are the client private keys of imported onions checked so far.
+	keys *clientKeys
+}
+
+// check returns the problems found with a forward, which imports with the
+// given client authorization, if any.
+func (v *validator) check(ctx context.Context, fwd *config.Forward, auth string) []problem {
+	var problems []problem
+	for _, err := range fwd.Warnings() {
+		problems = append(problems, problem{severityWarning, err})
+	}
+	if fwd.IsImport() {
+		if onionID, _ := fwd.Source().OnionID(); auth != "" {
+			if _, _, err := v.keys.add(onionID, auth); err != nil {
+				problems = append(problems, problem{severityError, err})
+			}
+		}
+		if dest := fwd.Destination(); !dest.IsUnix() {
+			if err := v.checkListen(dest); err != nil {
+				problems = append(problems, problem{severityError, err})
+			}
+		}
+		return problems
+	}
+	if alias := fwd.Destination().Alias(); alias != "" {
+		if _, ok := v.sec.ServiceKeys[alias]; !ok {
+			problems = append(problems, problem{severityWarning,
+				fmt.Errorf("alias %q has no service key yet; forwarding will create a new onion address", alias)})
+		}
+	}
+	endps := fwd.Backends()
+	for _, route := range fwd.HTTPProxy().Routes {
+		endps = append(endps, route.Backend)
+	}
+	for _, endp := range endps {
+		if err := v.checkDial(ctx, endp); err != nil {
+			problems = append(problems, problem{severityError, err})
+		}
+	}
+	return problems
+}
+
+// checkDial checks that a local endpoint accepts connections on each of its
+// addresses.
+func (v *validator) checkDial(ctx context.Context, endp *config.Endpoint) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	network := "tcp"
+	var addrs []string
+	var err error
+	switch {
+	case endp.IsUnix():
+		network = "unix"
+		var path string
+		path, err = endp.SingleAddr()
+		addrs = []string{path}
+	case endp.Resolution().Lazy:
+		var addr string
+		addr, err = endp.LookupAddr(ctx)
+		addrs = []string{addr}
+	default:
+		addrs, err = endp.Addrs()
+	}
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// checkListen checks that the local address of an import is free to listen
+// on.
+func (v *validator) checkListen(endp *config.Endpoint) error {
+	addr, err := endp.SingleAddr()
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
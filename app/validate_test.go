@@ -0,0 +1,96 @@
+package app
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// runValidate runs the validate command, returning its output and error.
+func runValidate(c *qt.C, args ...string) (string, error) {
+	in, out, err := os.Pipe()
+	c.Assert(err, qt.IsNil)
+	c.Patch(&os.Stdout, out)
+	errc := make(chan error, 1)
+	go func() {
+		defer out.Close()
+		errc <- App().Run(append([]string{"onionpipe", "validate"}, args...))
+	}()
+	output, err := io.ReadAll(in)
+	c.Assert(err, qt.IsNil)
+	return string(output), <-errc
+}
+
+func TestValidate(t *testing.T) {
+	c := qt.New(t)
+	c.Setenv("HOME", c.Mkdir())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+	listening := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	notListening := strconv.Itoa(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+
+	c.Run("ok", func(c *qt.C) {
+		output, err := runValidate(c, listening+"~80")
+		c.Assert(err, qt.IsNil)
+		c.Assert(output, qt.Equals, "ok: 127.0.0.1:"+listening+"~80\n")
+	})
+
+	c.Run("backend not listening", func(c *qt.C) {
+		output, err := runValidate(c, listening+"~80", notListening+"~81")
+		c.Assert(err, qt.ErrorMatches, `1 problem\(s\) found`)
+		c.Assert(output, qt.Matches, "ok: 127.0.0.1:"+listening+"~80\n"+
+			"error: 127.0.0.1:"+notListening+"~81: dial tcp .*: connection refused\n")
+	})
+
+	c.Run("alias without service key", func(c *qt.C) {
+		output, err := runValidate(c, listening+"~80@web")
+		c.Assert(err, qt.IsNil)
+		c.Assert(output, qt.Equals, "warning: 127.0.0.1:"+listening+"~80@web: "+
+			`alias "web" has no service key yet; forwarding will create a new onion address`+"\n"+
+			"ok: 127.0.0.1:"+listening+"~80@web\n")
+		_, err = os.Stat(defaultSecretsPath())
+		c.Assert(os.IsNotExist(err), qt.IsTrue)
+	})
+
+	c.Run("import", func(c *qt.C) {
+		output, err := runValidate(c, "--auth", "nobody", "xxx.onion:80~"+listening)
+		c.Assert(err, qt.ErrorMatches, `2 problem\(s\) found`)
+		c.Assert(output, qt.Matches, `error: xxx.onion:80~127.0.0.1:`+listening+`: failed to resolve client key "nobody"\n`+
+			`error: xxx.onion:80~127.0.0.1:`+listening+`: listen tcp .*: address already in use\n`)
+	})
+
+	c.Run("lazily resolved host not resolving yet", func(c *qt.C) {
+		output, err := runValidate(c, "--resolve", "dial", "not-started-yet.invalid:8000~80")
+		c.Assert(err, qt.ErrorMatches, `1 problem\(s\) found`)
+		c.Assert(output, qt.Matches, `warning: not-started-yet.invalid:8000~80: .*; will retry when connecting\n`+
+			`error: not-started-yet.invalid:8000~80: .*\n`)
+	})
+
+	c.Run("invalid forward", func(c *qt.C) {
+		output, err := runValidate(c, "80,81,82", listening+"~80", "80~81~82")
+		c.Assert(err, qt.ErrorMatches, `2 problem\(s\) found`)
+		c.Assert(output, qt.Matches, `error: 80,81,82: .*: local network address may only specify a single port\n`+
+			`error: 80~81~82: .*: invalid endpoint "81~82"\n`+
+			"ok: 127.0.0.1:"+listening+"~80\n")
+	})
+
+	c.Run("invalid config file", func(c *qt.C) {
+		configPath := filepath.Join(c.Mkdir(), "onionpipe.json")
+		c.Assert(os.WriteFile(configPath, []byte(`{"forwards": [`), 0600), qt.IsNil)
+		output, err := runValidate(c, "--config", configPath, "--require-auth", "not base32!", listening+"~80")
+		c.Assert(err, qt.ErrorMatches, `2 problem\(s\) found`)
+		c.Assert(output, qt.Matches, `error: invalid client auth "not base32!": .*\n`+
+			`error: .*onionpipe.json: .*\n`+
+			"ok: 127.0.0.1:"+listening+"~80\n")
+	})
+}
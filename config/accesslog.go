@@ -0,0 +1,106 @@
+package config
+
+import "fmt"
+
+// AccessLogFormat is the format of access log records.
+type AccessLogFormat string
+
+const (
+	// JSONLog writes each record as a line of JSON.
+	JSONLog AccessLogFormat = "json"
+	// CommonLog writes each record as a line in a format similar to the
+	// common log format of web servers.
+	CommonLog AccessLogFormat = "common"
+)
+
+// DefaultAccessLogBackups is the number of rotated access log files kept by
+// default.
+const DefaultAccessLogBackups = 5
+
+// AccessLog configures logging of each connection relayed through a forward.
+type AccessLog struct {
+	Format AccessLogFormat
+	// File is the path of the log file. If empty, records are written to
+	// stderr.
+	File string
+	// MaxSize is the size in bytes at which the log file is rotated. If
+	// zero, the file is not rotated.
+	MaxSize int64
+	// MaxBackups is the number of rotated log files kept.
+	MaxBackups int
+}
+
+// IsZero returns whether access logging is disabled.
+func (l AccessLog) IsZero() bool {
+	return l.Format == ""
+}
+
+// AccessLogDoc defines a JSON representation of an access log. The maximum
+// size is a string in the format accepted by ParseBytes. If the number of
+// backups is omitted, DefaultAccessLogBackups are kept; zero keeps none.
+type AccessLogDoc struct {
+	Format     string `json:"format,omitempty"`
+	File       string `json:"file,omitempty"`
+	MaxSize    string `json:"maxSize,omitempty"`
+	MaxBackups *int   `json:"maxBackups,omitempty"`
+}
+
+// AccessLog returns a validated AccessLog from a JSON document object model.
+func (d *AccessLogDoc) AccessLog() (AccessLog, error) {
+	var maxSize int64
+	if d.MaxSize != "" {
+		var err error
+		maxSize, err = ParseBytes(d.MaxSize)
+		if err != nil {
+			return AccessLog{}, fmt.Errorf("invalid maxSize: %w", err)
+		}
+	}
+	if d.MaxBackups != nil && *d.MaxBackups < 0 {
+		return AccessLog{}, fmt.Errorf("invalid maxBackups %d", *d.MaxBackups)
+	}
+	l, err := NewAccessLog(d.Format, d.File, maxSize)
+	if err != nil {
+		return AccessLog{}, err
+	}
+	if d.MaxBackups != nil {
+		l.MaxBackups = *d.MaxBackups
+	}
+	return l, nil
+}
+
+// Doc returns a JSON document object model of the access log.
+func (l AccessLog) Doc() *AccessLogDoc {
+	maxBackups := l.MaxBackups
+	d := &AccessLogDoc{
+		Format:     string(l.Format),
+		File:       l.File,
+		MaxBackups: &maxBackups,
+	}
+	if l.MaxSize > 0 {
+		d.MaxSize = FormatBytes(l.MaxSize)
+	}
+	return d
+}
+
+// NewAccessLog returns a new AccessLog in the given format, JSON lines by
+// default, written to a file or stderr if empty. The file is rotated at
+// maxSize bytes, if non-zero.
+func NewAccessLog(format, file string, maxSize int64) (AccessLog, error) {
+	l := AccessLog{
+		Format:     AccessLogFormat(format),
+		File:       file,
+		MaxSize:    maxSize,
+		MaxBackups: DefaultAccessLogBackups,
+	}
+	switch l.Format {
+	case "":
+		l.Format = JSONLog
+	case JSONLog, CommonLog:
+	default:
+		return AccessLog{}, fmt.Errorf("invalid access log format %q", format)
+	}
+	if maxSize > 0 && file == "" {
+		return AccessLog{}, fmt.Errorf("only access log files can be rotated")
+	}
+	return l, nil
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Balance defines how connections to an export are distributed among its
+// backends.
+type Balance string
+
+const (
+	// RoundRobin distributes connections to each backend in turn.
+	RoundRobin Balance = "round-robin"
+	// LeastConns distributes connections to the backend with the fewest
+	// active connections.
+	LeastConns Balance = "least-conns"
+	// Failover sends connections to the first available backend, in the
+	// order they are declared.
+	Failover Balance = "failover"
+)
+
+// ParseBalance returns a Balance from its string representation. An empty
+// string is the default, RoundRobin.
+func ParseBalance(s string) (Balance, error) {
+	switch b := Balance(s); b {
+	case "":
+		return RoundRobin, nil
+	case RoundRobin, LeastConns, Failover:
+		return b, nil
+	default:
+		return "", fmt.Errorf("invalid balance %q", s)
+	}
+}
+
+// ProxyProtocol defines which version of the HAProxy PROXY protocol header,
+// if any, is sent to an export's backends at the start of each connection.
+type ProxyProtocol string
+
+const (
+	// NoProxyProtocol sends no header.
+	NoProxyProtocol ProxyProtocol = ""
+	// ProxyProtocolV1 sends a human-readable version 1 header.
+	ProxyProtocolV1 ProxyProtocol = "v1"
+	// ProxyProtocolV2 sends a binary version 2 header.
+	ProxyProtocolV2 ProxyProtocol = "v2"
+)
+
+// ParseProxyProtocol returns a ProxyProtocol from its string representation.
+func ParseProxyProtocol(s string) (ProxyProtocol, error) {
+	switch p := ProxyProtocol(s); p {
+	case NoProxyProtocol, ProxyProtocolV1, ProxyProtocolV2:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid proxy protocol %q", s)
+	}
+}
+
+// HealthCheckType defines how a backend's health is checked.
+type HealthCheckType string
+
+const (
+	// TCPCheck checks that a backend accepts connections.
+	TCPCheck HealthCheckType = "tcp"
+	// HTTPCheck checks that a backend responds to an HTTP GET request with
+	// a successful or redirect status.
+	HTTPCheck HealthCheckType = "http"
+	// ExecCheck checks that a command exits successfully. The backend
+	// address is given to the command in the ONIONPIPE_BACKEND environment
+	// variable.
+	ExecCheck HealthCheckType = "exec"
+)
+
+// HealthPolicy defines what happens to an export when none of its backends
+// are healthy.
+type HealthPolicy string
+
+const (
+	// KeepPublished keeps the onion published, and keeps trying to connect
+	// to unhealthy backends.
+	KeepPublished HealthPolicy = "keep"
+	// Unpublish removes the export's onion service from Tor until a backend
+	// recovers. Other exports sharing the same onion address become
+	// unavailable along with it.
+	Unpublish HealthPolicy = "unpublish"
+	// ServeUnavailable responds to connections with a static "unavailable"
+	// response until a backend recovers.
+	ServeUnavailable HealthPolicy = "unavailable"
+)
+
+// DefaultUnavailableResponse is the static response served by the
+// ServeUnavailable policy, if none is configured.
+const DefaultUnavailableResponse = "HTTP/1.0 503 Service Unavailable\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Length: 20\r\n" +
+	"\r\n" +
+	"service unavailable\n"
+
+// Default health check settings.
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultHealthTimeout  = 2 * time.Second
+)
+
+// HealthCheck defines active health checks of an export's backends. A zero
+// Interval disables health checks.
+type HealthCheck struct {
+	// Type is how each backend is checked.
+	Type HealthCheckType
+	// Interval is how often each backend is checked.
+	Interval time.Duration
+	// Timeout is how long to wait for a check to succeed.
+	Timeout time.Duration
+	// Path is the request path of an HTTP check.
+	Path string
+	// Command is the command and arguments run by an exec check.
+	Command []string
+	// Policy is what happens when none of the backends are healthy.
+	Policy HealthPolicy
+	// Unavailable is the response served by the ServeUnavailable policy.
+	Unavailable string
+}
+
+// IsZero returns whether health checks are disabled.
+func (hc HealthCheck) IsZero() bool {
+	return hc.Interval == 0
+}
+
+// HealthCheckDoc defines a JSON representation of backend health checks.
+// Durations are strings in the format accepted by time.ParseDuration.
+type HealthCheckDoc struct {
+	Type        string   `json:"type,omitempty"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Command     []string `json:"command,omitempty"`
+	Policy      string   `json:"policy,omitempty"`
+	Unavailable string   `json:"unavailable,omitempty"`
+}
+
+// HealthCheck returns a validated HealthCheck from a JSON document object
+// model. Unset fields are given default values.
+func (d *HealthCheckDoc) HealthCheck() (HealthCheck, error) {
+	hc := HealthCheck{
+		Type:     TCPCheck,
+		Interval: DefaultHealthInterval,
+		Timeout:  DefaultHealthTimeout,
+		Path:     d.Path,
+		Command:  d.Command,
+		Policy:   KeepPublished,
+	}
+	switch t := HealthCheckType(d.Type); t {
+	case "":
+	case TCPCheck, HTTPCheck, ExecCheck:
+		hc.Type = t
+	default:
+		return HealthCheck{}, fmt.Errorf("invalid type %q", d.Type)
+	}
+	switch hc.Type {
+	case HTTPCheck:
+		if hc.Path == "" {
+			hc.Path = "/"
+		} else if hc.Path[0] != '/' {
+			return HealthCheck{}, fmt.Errorf("invalid path %q", hc.Path)
+		}
+	case ExecCheck:
+		if len(hc.Command) == 0 {
+			return HealthCheck{}, fmt.Errorf("exec check requires a command")
+		}
+	}
+	if hc.Type != HTTPCheck && hc.Path != "" {
+		return HealthCheck{}, fmt.Errorf("path only applies to http checks")
+	}
+	if hc.Type != ExecCheck && len(hc.Command) > 0 {
+		return HealthCheck{}, fmt.Errorf("command only applies to exec checks")
+	}
+	switch p := HealthPolicy(d.Policy); p {
+	case "":
+	case KeepPublished, Unpublish, ServeUnavailable:
+		hc.Policy = p
+	default:
+		return HealthCheck{}, fmt.Errorf("invalid policy %q", d.Policy)
+	}
+	if hc.Policy == ServeUnavailable {
+		hc.Unavailable = d.Unavailable
+		if hc.Unavailable == "" {
+			hc.Unavailable = DefaultUnavailableResponse
+		}
+	} else if d.Unavailable != "" {
+		return HealthCheck{}, fmt.Errorf("unavailable response only applies to the %q policy", ServeUnavailable)
+	}
+	var err error
+	if d.Interval != "" {
+		if hc.Interval, err = parseDuration("interval", d.Interval); err != nil {
+			return HealthCheck{}, err
+		}
+		if hc.Interval == 0 {
+			return HealthCheck{}, fmt.Errorf("invalid interval: must be positive")
+		}
+	}
+	if d.Timeout != "" {
+		if hc.Timeout, err = parseDuration("timeout", d.Timeout); err != nil {
+			return HealthCheck{}, err
+		}
+		if hc.Timeout == 0 {
+			return HealthCheck{}, fmt.Errorf("invalid timeout: must be positive")
+		}
+	}
+	return hc, nil
+}
+
+// Doc returns a JSON document object model of the health checks.
+func (hc HealthCheck) Doc() *HealthCheckDoc {
+	return &HealthCheckDoc{
+		Type:        string(hc.Type),
+		Interval:    formatDuration(hc.Interval),
+		Timeout:     formatDuration(hc.Timeout),
+		Path:        hc.Path,
+		Command:     hc.Command,
+		Policy:      string(hc.Policy),
+		Unavailable: hc.Unavailable,
+	}
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHealthCheck(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		name string
+		doc  HealthCheckDoc
+		hc   HealthCheck
+		err  string
+	}{{
+		name: "defaults",
+		hc: HealthCheck{
+			Type:     TCPCheck,
+			Interval: DefaultHealthInterval,
+			Timeout:  DefaultHealthTimeout,
+			Policy:   KeepPublished,
+		},
+	}, {
+		name: "http unpublish",
+		doc:  HealthCheckDoc{Type: "http", Interval: "1m", Policy: "unpublish"},
+		hc: HealthCheck{
+			Type:     HTTPCheck,
+			Interval: time.Minute,
+			Timeout:  DefaultHealthTimeout,
+			Path:     "/",
+			Policy:   Unpublish,
+		},
+	}, {
+		name: "exec unavailable",
+		doc:  HealthCheckDoc{Type: "exec", Command: []string{"pg_isready"}, Policy: "unavailable"},
+		hc: HealthCheck{
+			Type:        ExecCheck,
+			Interval:    DefaultHealthInterval,
+			Timeout:     DefaultHealthTimeout,
+			Command:     []string{"pg_isready"},
+			Policy:      ServeUnavailable,
+			Unavailable: DefaultUnavailableResponse,
+		},
+	}, {
+		name: "custom unavailable response",
+		doc:  HealthCheckDoc{Policy: "unavailable", Unavailable: "down for maintenance\n"},
+		hc: HealthCheck{
+			Type:        TCPCheck,
+			Interval:    DefaultHealthInterval,
+			Timeout:     DefaultHealthTimeout,
+			Policy:      ServeUnavailable,
+			Unavailable: "down for maintenance\n",
+		},
+	}, {
+		name: "invalid type",
+		doc:  HealthCheckDoc{Type: "icmp"},
+		err:  `invalid type "icmp"`,
+	}, {
+		name: "exec without command",
+		doc:  HealthCheckDoc{Type: "exec"},
+		err:  "exec check requires a command",
+	}, {
+		name: "tcp with path",
+		doc:  HealthCheckDoc{Path: "/healthz"},
+		err:  "path only applies to http checks",
+	}, {
+		name: "invalid path",
+		doc:  HealthCheckDoc{Type: "http", Path: "healthz"},
+		err:  `invalid path "healthz"`,
+	}, {
+		name: "invalid policy",
+		doc:  HealthCheckDoc{Policy: "panic"},
+		err:  `invalid policy "panic"`,
+	}, {
+		name: "unavailable response without policy",
+		doc:  HealthCheckDoc{Unavailable: "nope"},
+		err:  `unavailable response only applies to the "unavailable" policy`,
+	}, {
+		name: "zero interval",
+		doc:  HealthCheckDoc{Interval: "0s"},
+		err:  "invalid interval: must be positive",
+	}}
+	for i, test := range tests {
+		c.Run(fmt.Sprintf("%d %s", i, test.name), func(c *qt.C) {
+			hc, err := test.doc.HealthCheck()
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(hc, qt.DeepEquals, test.hc)
+		})
+	}
+}
@@ -4,8 +4,11 @@ package config
 
 import (
 	"context"
+	"encoding/base32"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -20,38 +23,162 @@ type Endpoint struct {
 	host  string
 	ports []int
 	path  string
+	// name is the host name the endpoint was configured with, once the host
+	// has been resolved to an address.
+	name string
 
+	family     AddressFamily
+	resolution Resolution
+	auth       string
+	mapped     bool
 	dest       bool
 	onion      bool
 	resolved   bool
 	alias      string
 	serviceKey []byte
+
+	// warning is a problem found resolving the endpoint which does not stop
+	// it from being used.
+	warning error
+	// limits are the timeouts given as options of an endpoint URL, which
+	// apply to the forward.
+	limits Limits
+}
+
+// AddressFamily is the IP address family preferred when resolving a host
+// name to an address.
+type AddressFamily string
+
+const (
+	// PreferIPv4 resolves host names to IPv4 addresses, or IPv6 addresses if
+	// the host has no IPv4 address. This is the default.
+	PreferIPv4 AddressFamily = "ipv4"
+	// PreferIPv6 resolves host names to IPv6 addresses, or IPv4 addresses if
+	// the host has no IPv6 address.
+	PreferIPv6 AddressFamily = "ipv6"
+)
+
+// ParseAddressFamily returns the AddressFamily named by s, which defaults to
+// PreferIPv4 if empty.
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch AddressFamily(s) {
+	case "", PreferIPv4:
+		return PreferIPv4, nil
+	case PreferIPv6:
+		return PreferIPv6, nil
+	}
+	return "", fmt.Errorf("invalid address family %q", s)
 }
 
 // EndpointDoc defines a JSON representation of an endpoint.
 type EndpointDoc struct {
-	Host  string `json:"host"`
-	Ports []int  `json:"ports"`
-	Path  string `json:"unix"`
-	Alias string `json:"alias"`
+	Host   string `json:"host"`
+	Ports  []int  `json:"ports"`
+	Path   string `json:"unix"`
+	Alias  string `json:"alias"`
+	Family string `json:"family,omitempty"`
+	// Resolve is when a source's host name is resolved, as accepted by
+	// ParseResolution.
+	Resolve string `json:"resolve,omitempty"`
+	// Auth is the client identity name or private key used to authorize
+	// with an imported onion service.
+	Auth string `json:"auth,omitempty"`
 }
 
 // Endpoint returns a validated and resolved Endpoint from a JSON document
 // object model.
 func (d *EndpointDoc) Endpoint(dest, asOnion bool) (*Endpoint, error) {
+	return d.endpoint(dest, asOnion, false)
+}
+
+// endpoint returns a validated and resolved Endpoint, whose ports may be
+// mapped one-to-one onto those of another endpoint.
+func (d *EndpointDoc) endpoint(dest, asOnion, mapped bool) (*Endpoint, error) {
+	if d.Alias != "" && !(dest && asOnion) {
+		return nil, fmt.Errorf("only remote onions can be aliased")
+	}
+	var family AddressFamily
+	if d.Family != "" {
+		var err error
+		family, err = ParseAddressFamily(d.Family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolution, err := ParseResolution(d.Resolve)
+	if err != nil {
+		return nil, err
+	}
 	e := &Endpoint{
-		host:  d.Host,
-		ports: d.Ports,
-		path:  d.Path,
-		dest:  dest,
+		host:       d.Host,
+		ports:      d.Ports,
+		path:       d.Path,
+		dest:       dest,
+		alias:      d.Alias,
+		family:     family,
+		resolution: resolution,
+		auth:       d.Auth,
+		mapped:     mapped && len(d.Ports) > 1,
 	}
-	err := e.Resolve(asOnion)
+	err = e.Resolve(asOnion)
 	if err != nil {
 		return nil, err
 	}
 	return e, nil
 }
 
+// Doc returns a JSON document object model of the endpoint. The service key
+// of an onion destination is not included, nor is client authorization given
+// as a private key rather than a client identity name.
+func (e *Endpoint) Doc() EndpointDoc {
+	return EndpointDoc{
+		Host:    e.HostName(),
+		Ports:   e.ports,
+		Path:    e.path,
+		Alias:   e.alias,
+		Family:  string(e.family),
+		Resolve: e.resolution.String(),
+		Auth:    e.authName(),
+	}
+}
+
+// authName returns the endpoint's client authorization if it names a client
+// identity, leaving out private keys so that they are not disclosed.
+func (e *Endpoint) authName() string {
+	if isClientPrivateKey(e.auth) {
+		return ""
+	}
+	return e.auth
+}
+
+// isClientPrivateKey returns whether client authorization is given as a
+// base32 encoded private key, as the secrets store resolves it, rather than a
+// client identity name.
+func isClientPrivateKey(auth string) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(auth))
+	return err == nil && len(key) == 32
+}
+
+// HostName returns the host the endpoint was configured with, which is a host
+// name rather than the address it resolved to, if it was given one.
+func (e *Endpoint) HostName() string {
+	if e.name != "" {
+		return e.name
+	}
+	return e.host
+}
+
+// configuredAddr returns the address of the endpoint as it was configured,
+// for serializing it. Unlike SingleAddr, this cannot fail: a resolved
+// endpoint is either a UNIX socket or has a host and ports, if only onion
+// ports.
+func (e *Endpoint) configuredAddr() string {
+	if e.path != "" {
+		return e.path
+	}
+	return net.JoinHostPort(e.HostName(), formatPortList(e.ports))
+}
+
 // IsOnionHost returns whether the host is a .onion address.
 func IsOnionHost(s string) bool {
 	return strings.HasSuffix(s, ".onion")
@@ -82,6 +209,24 @@ func (e *Endpoint) IsUnix() bool {
 	return e.path != ""
 }
 
+// Resolution returns when the endpoint's host name is resolved.
+func (e *Endpoint) Resolution() Resolution {
+	return e.resolution
+}
+
+// Auth returns the client authorization, a client identity name or private
+// key, with which an imported onion is connected to, if any.
+func (e *Endpoint) Auth() string {
+	return e.auth
+}
+
+// Warning returns a problem found when the endpoint was resolved which does
+// not stop it from being used, such as a lazily resolved host name which does
+// not resolve yet. Nil is returned if there is none.
+func (e *Endpoint) Warning() error {
+	return e.warning
+}
+
 // Alias returns the endpoint's alias, if it has one.
 func (e *Endpoint) Alias() string {
 	return e.alias
@@ -100,7 +245,8 @@ func (e *Endpoint) ServiceKey() []byte {
 // Resolve validates the endpoint to ensure it is well-formed. For UNIX socket
 // endpoints, the socket path is validated for existence. For local network
 // TCP socket endpoints, the host is resolved to a network address according to
-// the system's default name resolver.
+// the system's default name resolver, preferring the endpoint's address
+// family.
 //
 // asOnion is provided to disambiguate an endpoint that does not yet have its
 // host resolved.
@@ -116,6 +262,12 @@ func (e *Endpoint) Resolve(asOnion bool) error {
 	if e.resolved {
 		return nil
 	}
+	if e.resolution.Lazy && (e.dest || asOnion || IsOnionHost(e.host) || e.path != "") {
+		return fmt.Errorf("only local source host names may be resolved lazily")
+	}
+	if e.auth != "" && (e.dest || !IsOnionHost(e.host)) {
+		return fmt.Errorf("client authorization only applies to imported onions")
+	}
 
 	// Resolving onions
 	if asOnion || IsOnionHost(e.host) {
@@ -154,6 +306,10 @@ func (e *Endpoint) Resolve(asOnion bool) error {
 		return nil
 	}
 
+	if e.onion {
+		return fmt.Errorf("onion endpoint must be an onion address to import, or the ports of an export")
+	}
+
 	// Resolving UNIX sockets
 	if e.path != "" {
 		if e.host != "" || len(e.ports) > 0 {
@@ -168,27 +324,89 @@ func (e *Endpoint) Resolve(asOnion bool) error {
 		return nil
 	}
 
-	// Resolving local TCP addresses
-	if len(e.ports) != 1 {
+	// Resolving local TCP addresses. A source may specify a range or mapping
+	// of ports, which are mapped one-to-one onto the destination's.
+	if len(e.ports) != 1 && (e.dest || !e.mapped) {
 		return fmt.Errorf("local network address may only specify a single port")
 	}
 	if e.host == "" {
 		e.host = "127.0.0.1"
+		e.resolution = Resolution{}
+		e.resolved = true
+		return nil
+	}
+	if addr, err := netip.ParseAddr(e.host); err == nil {
+		// Addresses need no resolving, lazily or otherwise.
+		e.host = addr.String()
+		e.resolution = Resolution{}
+		e.resolved = true
+		return nil
+	}
+	if e.resolution.Lazy {
+		// Keep the host name to resolve when connecting, but warn early
+		// about names that do not resolve yet.
+		if _, err := lookupHost(context.Background(), e.host, e.family); err != nil {
+			e.warning = fmt.Errorf("%w; will retry when connecting", err)
+		}
 		e.resolved = true
 		return nil
 	}
-	addrs, err := net.DefaultResolver.LookupIP(context.Background(), "ip4", e.host)
+	addr, err := lookupHost(context.Background(), e.host, e.family)
 	if err != nil {
 		return err
 	}
-	if len(addrs) == 0 {
-		return fmt.Errorf("could not resolve %q", e.host)
-	}
-	e.host = addrs[0].String()
+	e.name, e.host = e.host, addr.String()
 	e.resolved = true
 	return nil
 }
 
+// LookupAddr returns the endpoint's address for a single port. The host name
+// of a lazily resolved endpoint is resolved each time.
+func (e *Endpoint) LookupAddr(ctx context.Context) (string, error) {
+	if !e.resolution.Lazy {
+		return e.SingleAddr()
+	}
+	if len(e.ports) != 1 {
+		return "", fmt.Errorf("endpoint does not represent a single address")
+	}
+	addr, err := lookupHost(ctx, e.host, e.family)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addr.String(), strconv.Itoa(e.ports[0])), nil
+}
+
+// lookupHost resolves a host name to an address, preferring the given family.
+func lookupHost(ctx context.Context, host string, family AddressFamily) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	addr, ok := preferredAddr(addrs, family)
+	if !ok {
+		return netip.Addr{}, fmt.Errorf("could not resolve %q", host)
+	}
+	return addr, nil
+}
+
+// preferredAddr returns the first of the addresses in the preferred family, or
+// the first address if there are none in that family.
+func preferredAddr(addrs []netip.Addr, family AddressFamily) (netip.Addr, bool) {
+	if len(addrs) == 0 {
+		return netip.Addr{}, false
+	}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() == (family != PreferIPv6) {
+			return addr, true
+		}
+	}
+	return addrs[0].Unmap(), true
+}
+
 // SingleAddr returns the string representation of the endpoint as a single
 // address in a port or socket forward. Some endpoints do not have such a
 // representation, in which case an error is returned.
@@ -203,7 +421,7 @@ func (e *Endpoint) SingleAddr() (string, error) {
 		}
 	case 1:
 		if e.host != "" {
-			return fmt.Sprintf("%s:%d", e.host, e.ports[0]), nil
+			return net.JoinHostPort(e.host, strconv.Itoa(e.ports[0])), nil
 		}
 	default:
 		return "", fmt.Errorf("endpoint does not represent a single address")
@@ -216,11 +434,10 @@ func (e *Endpoint) SingleAddr() (string, error) {
 // provided, to render the assigned onion address.
 func (e *Endpoint) Description(remoteOnions map[string]string) string {
 	if e.onion && e.dest {
-		ports := make([]string, len(e.ports))
-		for i := range e.ports {
-			ports[i] = strconv.Itoa(e.ports[i])
-		}
-		return fmt.Sprintf("%s.onion:%s", remoteOnions[e.alias], strings.Join(ports, ","))
+		return fmt.Sprintf("%s.onion:%s", remoteOnions[e.alias], formatPortList(e.ports))
+	}
+	if e.mapped && e.host != "" {
+		return net.JoinHostPort(e.host, formatPortList(e.ports))
 	}
 	addr, err := e.SingleAddr()
 	if err != nil {
@@ -234,14 +451,32 @@ func (e *Endpoint) Ports() []int {
 	return e.ports
 }
 
-var remotePortsRE = regexp.MustCompile(`^\d+(,\d+)*$`)
+// Addrs returns the address of each of the endpoint's ports, for a resolved
+// local network endpoint.
+func (e *Endpoint) Addrs() ([]string, error) {
+	if e.onion || e.path != "" || e.host == "" {
+		return nil, fmt.Errorf("not a local network address")
+	}
+	addrs := make([]string, len(e.ports))
+	for i := range e.ports {
+		addrs[i] = net.JoinHostPort(e.host, strconv.Itoa(e.ports[i]))
+	}
+	return addrs, nil
+}
+
+var remotePortsRE = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
 
 // ParseEndpoint returns an Endpoint from the given string representation and
 // whether it is intended to be used as a destination or source in a forward.
+// Endpoints may be given in short form, such as 8000, host:8000 or a UNIX
+// socket path, or in URL form; see parseEndpointURL.
 func ParseEndpoint(s string, dest bool) (*Endpoint, error) {
 	if s == "" {
 		return nil, fmt.Errorf("missing value")
 	}
+	if isEndpointURL(s) {
+		return parseEndpointURL(s, dest)
+	}
 
 	var alias string
 	if parts := strings.Split(s, "@"); len(parts) == 2 {
@@ -255,7 +490,7 @@ func ParseEndpoint(s string, dest bool) (*Endpoint, error) {
 		if err != nil {
 			return nil, err
 		}
-		return &Endpoint{ports: ports, dest: dest, alias: alias}, nil
+		return &Endpoint{ports: ports, mapped: !dest && isPortRange(s), dest: dest, alias: alias}, nil
 	}
 
 	if alias != "" {
@@ -278,22 +513,165 @@ func ParseEndpoint(s string, dest bool) (*Endpoint, error) {
 	}
 
 	// Otherwise endpoint is some form of host:port then
-	parts := strings.SplitN(s, ":", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid endpoint %q", s)
+	host, portStr, err := splitHostPort(s)
+	if err != nil {
+		return nil, err
 	}
-	port, err := strconv.Atoi(parts[1])
+	ports, err := parseAddrPorts(portStr)
 	if err != nil {
-		return nil, fmt.Errorf("invalid port: %w", err)
+		return nil, err
 	}
 	endp := &Endpoint{
-		host:  parts[0],
-		ports: []int{port},
-		dest:  dest,
+		host:   host,
+		ports:  ports,
+		mapped: !dest && len(ports) > 1,
+		dest:   dest,
 	}
 	return endp, nil
 }
 
+// parseAddrPorts parses the port of a local network address, which may be a
+// range of ports.
+func parseAddrPorts(s string) ([]int, error) {
+	if isPortRange(s) {
+		return parsePortList(s)
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	if err := checkPort(port); err != nil {
+		return nil, err
+	}
+	return []int{port}, nil
+}
+
+// Endpoint URL schemes.
+const (
+	tcpScheme   = "tcp"
+	unixScheme  = "unix"
+	onionScheme = "onion"
+)
+
+// isEndpointURL returns whether an endpoint is given in URL form.
+func isEndpointURL(s string) bool {
+	scheme, _, ok := strings.Cut(s, "://")
+	return ok && !strings.ContainsAny(scheme, ":/@~")
+}
+
+// parseEndpointURL parses an endpoint in URL form, which is unambiguous where
+// the short form is not:
+//
+//	tcp://host:port      a local network address; a source may give a range
+//	unix:///path         a UNIX socket, which must exist, even if relative
+//	onion://alias:80,443 onion ports published by an export, optionally aliased
+//	onion://xxx.onion:80 an onion service to import
+//
+// Endpoint options are given as query parameters: family, resolve and auth,
+// as in endpoint documents, and the forward's dialTimeout and idleTimeout, as
+// in limits documents.
+func parseEndpointURL(s string, dest bool) (*Endpoint, error) {
+	scheme, rest, _ := strings.Cut(s, "://")
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	var e *Endpoint
+	switch scheme {
+	case tcpScheme:
+		host, portStr, err := splitHostPort(rest)
+		if err != nil {
+			return nil, err
+		}
+		if IsOnionHost(host) {
+			return nil, fmt.Errorf("invalid endpoint %q: onion addresses are given as %s://", s, onionScheme)
+		}
+		ports, err := parseAddrPorts(portStr)
+		if err != nil {
+			return nil, err
+		}
+		e = &Endpoint{host: host, ports: ports, mapped: !dest && len(ports) > 1, dest: dest}
+	case unixScheme:
+		if rest == "" {
+			return nil, fmt.Errorf("invalid endpoint %q: missing UNIX socket path", s)
+		}
+		e = &Endpoint{path: rest, dest: dest}
+	case onionScheme:
+		host, portStr, ok := strings.Cut(rest, ":")
+		var ports []int
+		if ok {
+			var err error
+			ports, err = parsePortList(portStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// Onion endpoints are marked as such, so that one given where a
+		// local endpoint is expected is not mistaken for one.
+		e = &Endpoint{ports: ports, dest: dest, onion: true}
+		if IsOnionHost(host) {
+			e.host = host
+		} else {
+			e.alias = host
+		}
+	default:
+		return nil, fmt.Errorf("invalid endpoint %q: unsupported scheme %q", s, scheme)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", s, err)
+	}
+	for name, values := range query {
+		if len(values) != 1 {
+			return nil, fmt.Errorf("invalid endpoint %q: option %q given more than once", s, name)
+		}
+		switch name {
+		case "family":
+			e.family, err = ParseAddressFamily(values[0])
+		case "resolve":
+			e.resolution, err = ParseResolution(values[0])
+		case "auth":
+			e.auth = values[0]
+		case "dialTimeout":
+			e.limits.DialTimeout, err = parseDuration(name, values[0])
+		case "idleTimeout":
+			e.limits.IdleTimeout, err = parseDuration(name, values[0])
+		default:
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", s, err)
+		}
+	}
+	return e, nil
+}
+
+// splitHostPort splits a host:port address, where an IPv6 host must be
+// bracketed, as in [::1]:8000.
+func splitHostPort(s string) (host, port string, err error) {
+	if strings.HasPrefix(s, "[") {
+		host, port, err = net.SplitHostPort(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid endpoint %q", s)
+		}
+		if _, err := netip.ParseAddr(host); err != nil || !strings.Contains(host, ":") {
+			return "", "", fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		return host, port, nil
+	}
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid endpoint %q", s)
+	}
+	if strings.Contains(port, ":") {
+		return "", "", fmt.Errorf("invalid port %q: IPv6 addresses must be bracketed, as in [::1]:8000", port)
+	}
+	return host, port, nil
+}
+
+// maxPortRange is the largest number of ports a range may span, which keeps
+// mistyped ranges from publishing thousands of onion ports.
+const maxPortRange = 1024
+
+// parsePortList parses a comma-separated list of ports and port ranges, such
+// as 80,443,8000-8010.
 func parsePortList(s string) ([]int, error) {
 	parts := strings.Split(s, ",")
 	if len(parts) == 0 {
@@ -301,11 +679,92 @@ func parsePortList(s string) ([]int, error) {
 	}
 	var ports []int
 	for i := range parts {
-		port, err := strconv.Atoi(parts[i])
+		first, last, isRange := strings.Cut(parts[i], "-")
+		start, err := strconv.Atoi(first)
 		if err != nil {
 			return nil, fmt.Errorf("invalid port number %q", parts[i])
 		}
-		ports = append(ports, port)
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q", parts[i])
+			}
+			if end <= start {
+				return nil, fmt.Errorf("invalid port range %q: must be ascending", parts[i])
+			}
+			if end-start+1 > maxPortRange {
+				return nil, fmt.Errorf("invalid port range %q: may span at most %d ports", parts[i], maxPortRange)
+			}
+		}
+		for port := start; port <= end; port++ {
+			ports = append(ports, port)
+		}
+	}
+	if err := checkPortList(ports); err != nil {
+		return nil, err
 	}
 	return ports, nil
 }
+
+// checkPortList checks that the ports are in range and not repeated.
+func checkPortList(ports []int) error {
+	seen := map[int]bool{}
+	for _, port := range ports {
+		if err := checkPort(port); err != nil {
+			return err
+		}
+		if seen[port] {
+			return fmt.Errorf("duplicate port %d", port)
+		}
+		seen[port] = true
+	}
+	return nil
+}
+
+// isPortRange returns whether s is a single port range, such as 9000-9010.
+func isPortRange(s string) bool {
+	return strings.Contains(s, "-") && !strings.Contains(s, ",")
+}
+
+func checkPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	return nil
+}
+
+// formatPortList formats ports as a comma-separated list, in which runs of
+// consecutive ports are formatted as ranges.
+func formatPortList(ports []int) string {
+	var parts []string
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		if j > i {
+			parts = append(parts, fmt.Sprintf("%d-%d", ports[i], ports[j]))
+		} else {
+			parts = append(parts, strconv.Itoa(ports[i]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// formatPortMap formats source ports mapped one-to-one onto destination ports
+// as a comma-separated list of mappings, in which runs of consecutive ports
+// on both sides are formatted as ranges.
+func formatPortMap(src, dest []int) string {
+	var parts []string
+	for i := 0; i < len(src); {
+		j := i
+		for j+1 < len(src) && src[j+1] == src[j]+1 && dest[j+1] == dest[j]+1 {
+			j++
+		}
+		parts = append(parts, formatPortList(src[i:j+1])+"="+formatPortList(dest[i:j+1]))
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
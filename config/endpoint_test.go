@@ -1,10 +1,13 @@
 package config
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"path/filepath"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
@@ -86,8 +89,55 @@ func TestEndpoint(t *testing.T) {
 		dest:       false,
 		parsed:     &Endpoint{host: "localhost", ports: []int{25565}, dest: false},
 		asOnion:    false,
-		resolved:   &Endpoint{host: "127.0.0.1", ports: []int{25565}, dest: false, resolved: true},
+		resolved:   &Endpoint{host: "127.0.0.1", name: "localhost", ports: []int{25565}, dest: false, resolved: true},
 		singleAddr: "127.0.0.1:25565",
+	}, {
+		name:       "explicit ipv6 local src, single port",
+		in:         "[::1]:8000",
+		dest:       false,
+		parsed:     &Endpoint{host: "::1", ports: []int{8000}, dest: false},
+		asOnion:    false,
+		resolved:   &Endpoint{host: "::1", ports: []int{8000}, dest: false, resolved: true},
+		singleAddr: "[::1]:8000",
+	}, {
+		name:       "explicit ipv6 local dest with zone, single port",
+		in:         "[fe80::1%eth0]:8000",
+		dest:       true,
+		parsed:     &Endpoint{host: "fe80::1%eth0", ports: []int{8000}, dest: true},
+		asOnion:    false,
+		resolved:   &Endpoint{host: "fe80::1%eth0", ports: []int{8000}, dest: true, resolved: true},
+		singleAddr: "[fe80::1%eth0]:8000",
+	}, {
+		name:          "implicit onion dest, port range",
+		in:            "9000-9002",
+		dest:          true,
+		parsed:        &Endpoint{ports: []int{9000, 9001, 9002}, dest: true},
+		asOnion:       true,
+		resolved:      &Endpoint{ports: []int{9000, 9001, 9002}, dest: true, onion: true, resolved: true},
+		singleAddrErr: "onion destination",
+	}, {
+		name:          "implicit onion dest, ports and ranges",
+		in:            "80,443,8000-8002",
+		dest:          true,
+		parsed:        &Endpoint{ports: []int{80, 443, 8000, 8001, 8002}, dest: true},
+		asOnion:       true,
+		resolved:      &Endpoint{ports: []int{80, 443, 8000, 8001, 8002}, dest: true, onion: true, resolved: true},
+		singleAddrErr: "onion destination",
+	}, {
+		name:          "explicit local src, port range",
+		in:            "localhost:9000-9001",
+		dest:          false,
+		parsed:        &Endpoint{host: "localhost", ports: []int{9000, 9001}, mapped: true},
+		asOnion:       false,
+		resolved:      &Endpoint{host: "127.0.0.1", name: "localhost", ports: []int{9000, 9001}, mapped: true, resolved: true},
+		singleAddrErr: "endpoint does not represent a single address",
+	}, {
+		name:       "explicit local dest, port range",
+		in:         "127.0.0.1:9000-9001",
+		dest:       true,
+		parsed:     &Endpoint{host: "127.0.0.1", ports: []int{9000, 9001}, dest: true},
+		asOnion:    false,
+		resolveErr: "local network address may only specify a single port",
 	}, {
 		name:       "unix dest",
 		in:         socketPath,
@@ -160,6 +210,56 @@ func TestEndpoint(t *testing.T) {
 		in:       "1.2.3.4:5432@postgres",
 		dest:     true,
 		parseErr: "only remote onions can be aliased",
+	}, {
+		name:     "unbracketed ipv6",
+		in:       "::1:8000",
+		dest:     false,
+		parseErr: `invalid port ":1:8000": IPv6 addresses must be bracketed, as in \[::1\]:8000`,
+	}, {
+		name:     "bracketed name",
+		in:       "[localhost]:8000",
+		dest:     false,
+		parseErr: `invalid IPv6 address "localhost"`,
+	}, {
+		name:     "bracketed ipv4",
+		in:       "[127.0.0.1]:8000",
+		dest:     false,
+		parseErr: `invalid IPv6 address "127.0.0.1"`,
+	}, {
+		name:     "bracketed ipv6, no port",
+		in:       "[::1]",
+		dest:     false,
+		parseErr: `invalid endpoint "\[::1\]"`,
+	}, {
+		name:     "descending port range",
+		in:       "9010-9000",
+		dest:     true,
+		parseErr: `invalid port range "9010-9000": must be ascending`,
+	}, {
+		name:     "port out of range",
+		in:       "65535-65536",
+		dest:     true,
+		parseErr: `port 65536 out of range`,
+	}, {
+		name:     "local port out of range",
+		in:       "localhost:0",
+		dest:     false,
+		parseErr: `port 0 out of range`,
+	}, {
+		name:     "duplicate port",
+		in:       "80,8000-8080,8080",
+		dest:     true,
+		parseErr: `duplicate port 8080`,
+	}, {
+		name:     "huge port range",
+		in:       "1-65535",
+		dest:     true,
+		parseErr: `invalid port range "1-65535": may span at most 1024 ports`,
+	}, {
+		name:     "local port list",
+		in:       "localhost:80,81",
+		dest:     false,
+		parseErr: `invalid port: .*`,
 	}, {
 		/* Syntactically invalid */
 		name:     "empty w/alias",
@@ -212,3 +312,162 @@ func TestEndpoint(t *testing.T) {
 		})
 	}
 }
+
+func TestPreferredAddr(t *testing.T) {
+	c := qt.New(t)
+	v4, v6 := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")
+	mapped := netip.MustParseAddr("::ffff:10.0.0.2")
+	tests := []struct {
+		name   string
+		addrs  []netip.Addr
+		family AddressFamily
+		addr   netip.Addr
+		ok     bool
+	}{{
+		name: "none",
+	}, {
+		name:  "default prefers ipv4",
+		addrs: []netip.Addr{v6, v4},
+		addr:  v4,
+		ok:    true,
+	}, {
+		name:   "prefer ipv4",
+		addrs:  []netip.Addr{v6, v4},
+		family: PreferIPv4,
+		addr:   v4,
+		ok:     true,
+	}, {
+		name:   "prefer ipv6",
+		addrs:  []netip.Addr{v4, v6},
+		family: PreferIPv6,
+		addr:   v6,
+		ok:     true,
+	}, {
+		name:   "ipv6 only",
+		addrs:  []netip.Addr{v6},
+		family: PreferIPv4,
+		addr:   v6,
+		ok:     true,
+	}, {
+		name:   "ipv4 only",
+		addrs:  []netip.Addr{v4},
+		family: PreferIPv6,
+		addr:   v4,
+		ok:     true,
+	}, {
+		name:   "ipv4-mapped ipv6",
+		addrs:  []netip.Addr{v6, mapped},
+		family: PreferIPv4,
+		addr:   netip.MustParseAddr("10.0.0.2"),
+		ok:     true,
+	}}
+	for _, test := range tests {
+		c.Run(test.name, func(c *qt.C) {
+			addr, ok := preferredAddr(test.addrs, test.family)
+			c.Assert(ok, qt.Equals, test.ok)
+			c.Assert(addr, qt.Equals, test.addr)
+		})
+	}
+}
+
+func TestParseAddressFamily(t *testing.T) {
+	c := qt.New(t)
+	for in, family := range map[string]AddressFamily{"": PreferIPv4, "ipv4": PreferIPv4, "ipv6": PreferIPv6} {
+		got, err := ParseAddressFamily(in)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, family)
+	}
+	_, err := ParseAddressFamily("ipx")
+	c.Assert(err, qt.ErrorMatches, `invalid address family "ipx"`)
+}
+
+func TestParseResolution(t *testing.T) {
+	c := qt.New(t)
+	for in, res := range map[string]Resolution{
+		"":     {},
+		"once": {},
+		"dial": {Lazy: true},
+		"30s":  {Lazy: true, TTL: 30 * time.Second},
+	} {
+		got, err := ParseResolution(in)
+		c.Assert(err, qt.IsNil)
+		c.Assert(got, qt.Equals, res)
+		if in != "once" {
+			c.Assert(got.String(), qt.Equals, in)
+		}
+	}
+	for _, in := range []string{"always", "-1s", "0s"} {
+		_, err := ParseResolution(in)
+		c.Assert(err, qt.ErrorMatches, `invalid resolution ".*": must be "once", "dial" or a positive duration`)
+	}
+}
+
+func TestResolveLazily(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		name       string
+		doc        EndpointDoc
+		dest       bool
+		host       string
+		lazy       bool
+		warning    string
+		resolveErr string
+	}{{
+		name: "host name is kept",
+		doc:  EndpointDoc{Host: "localhost", Ports: []int{8000}, Resolve: "dial"},
+		host: "localhost",
+		lazy: true,
+	}, {
+		name:    "unresolvable host name is kept",
+		doc:     EndpointDoc{Host: "not-started-yet.invalid", Ports: []int{8000}, Resolve: "10s"},
+		host:    "not-started-yet.invalid",
+		lazy:    true,
+		warning: `.*not-started-yet.invalid.*; will retry when connecting`,
+	}, {
+		name: "address needs no resolving",
+		doc:  EndpointDoc{Host: "10.1.1.1", Ports: []int{8000}, Resolve: "dial"},
+		host: "10.1.1.1",
+	}, {
+		name:       "destination",
+		doc:        EndpointDoc{Host: "localhost", Ports: []int{8000}, Resolve: "dial"},
+		dest:       true,
+		resolveErr: "only local source host names may be resolved lazily",
+	}, {
+		name:       "onion",
+		doc:        EndpointDoc{Host: "xxx.onion", Ports: []int{80}, Resolve: "dial"},
+		resolveErr: "only local source host names may be resolved lazily",
+	}}
+	for _, test := range tests {
+		c.Run(test.name, func(c *qt.C) {
+			e, err := test.doc.endpoint(test.dest, false, false)
+			if test.resolveErr != "" {
+				c.Assert(err, qt.ErrorMatches, test.resolveErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(e.host, qt.Equals, test.host)
+			c.Assert(e.Resolution().Lazy, qt.Equals, test.lazy)
+			if test.warning != "" {
+				c.Assert(e.Warning(), qt.ErrorMatches, test.warning)
+			} else {
+				c.Assert(e.Warning(), qt.IsNil)
+			}
+			if test.lazy {
+				c.Assert(e.Doc().Resolve, qt.Equals, test.doc.Resolve)
+			}
+		})
+	}
+}
+
+func TestLookupAddr(t *testing.T) {
+	c := qt.New(t)
+	doc := EndpointDoc{Host: "localhost", Ports: []int{8000}, Resolve: "dial"}
+	e, err := doc.endpoint(false, false, false)
+	c.Assert(err, qt.IsNil)
+	addr, err := e.LookupAddr(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr, qt.Equals, "127.0.0.1:8000")
+	singleAddr, err := e.SingleAddr()
+	c.Assert(err, qt.IsNil)
+	c.Assert(singleAddr, qt.Equals, "localhost:8000")
+}
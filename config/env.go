@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ExpandEnv replaces ${VAR} in s with the value of the environment variable
+// VAR. Unlike os.ExpandEnv, only the braced form is expanded, so that other
+// uses of $, in passwords for example, are left alone, and $${ is a literal
+// ${. An undefined variable is an error, rather than expanding to nothing.
+func ExpandEnv(s string) (string, error) {
+	return expandEnv(s, os.LookupEnv)
+}
+
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			sb.WriteString(s[:i-1])
+			sb.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		sb.WriteString(s[:i])
+		name, rest, ok := strings.Cut(s[i+2:], "}")
+		if !ok {
+			return "", fmt.Errorf("unterminated variable reference in %q", s)
+		}
+		if name == "" {
+			return "", fmt.Errorf("empty variable reference in %q", s)
+		}
+		value, ok := lookup(name)
+		if !ok {
+			return "", fmt.Errorf("undefined variable %q", name)
+		}
+		sb.WriteString(value)
+		s = rest
+	}
+}
+
+// expandEnvValues expands environment variables in the string values of a
+// decoded JSON document, in place.
+func expandEnvValues(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case string:
+		return ExpandEnv(v)
+	case []interface{}:
+		for i := range v {
+			if v[i], err = expandEnvValues(v[i]); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]interface{}:
+		for k := range v {
+			if v[k], err = expandEnvValues(v[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestExpandEnv(t *testing.T) {
+	c := qt.New(t)
+	lookup := func(name string) (string, bool) {
+		v, ok := map[string]string{"HOST": "app", "PORT": "8000", "EMPTY": ""}[name]
+		return v, ok
+	}
+	tests := []struct {
+		in, out, err string
+	}{{
+		in:  "${HOST}:${PORT}~80",
+		out: "app:8000~80",
+	}, {
+		in:  "x${EMPTY}y",
+		out: "xy",
+	}, {
+		in:  "pa$$word$HOST",
+		out: "pa$$word$HOST",
+	}, {
+		in:  "$${HOST} is ${HOST}",
+		out: "${HOST} is app",
+	}, {
+		in:  "${MISSING}:8000",
+		err: `undefined variable "MISSING"`,
+	}, {
+		in:  "${HOST:8000",
+		err: `unterminated variable reference in "\${HOST:8000"`,
+	}, {
+		in:  "${}",
+		err: `empty variable reference in "\${}"`,
+	}}
+	for _, test := range tests {
+		c.Run(test.in, func(c *qt.C) {
+			out, err := expandEnv(test.in, lookup)
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(out, qt.Equals, test.out)
+		})
+	}
+}
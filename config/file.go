@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// FileDoc defines the JSON representation of an onionpipe configuration file.
+type FileDoc struct {
+	Forwards []ForwardDoc `json:"forwards"`
+}
+
+// ReadFile returns validated and resolved forwards declared in the JSON
+// configuration file at the given path. ${VAR} environment variable
+// references in string values are expanded.
+func ReadFile(path string) ([]*Forward, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fwds, err := read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fwds, nil
+}
+
+// WriteFile writes forwards to a JSON configuration file at the given path,
+// from which ReadFile reads equivalent forwards, except that client private
+// keys are left out. The file is only readable by its owner, as it may name
+// client identities.
+func WriteFile(path string, fwds []*Forward) error {
+	var buf bytes.Buffer
+	if err := write(&buf, fwds); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+func write(w io.Writer, fwds []*Forward) error {
+	doc := FileDoc{Forwards: []ForwardDoc{}}
+	for _, fwd := range fwds {
+		doc.Forwards = append(doc.Forwards, *fwd.Doc())
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&doc)
+}
+
+func read(r io.Reader) ([]*Forward, error) {
+	// Expand environment variables in string values before decoding, so
+	// that values with quotes and such need no escaping.
+	var raw interface{}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	raw, err := expandEnvValues(raw)
+	if err != nil {
+		return nil, err
+	}
+	expanded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var doc FileDoc
+	dec = json.NewDecoder(bytes.NewReader(expanded))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	var fwds []*Forward
+	for i := range doc.Forwards {
+		fwd, err := doc.Forwards[i].Forward()
+		if err != nil {
+			return nil, fmt.Errorf("forward %d: %w", i, err)
+		}
+		fwds = append(fwds, fwd)
+	}
+	return fwds, nil
+}
@@ -0,0 +1,625 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadFile(t *testing.T) {
+	c := qt.New(t)
+
+	tests := []struct {
+		name    string
+		in      string
+		parsed  []*Forward
+		readErr string
+	}{{
+		name: "export with limits",
+		in: `{"forwards": [{
+			"src": {"host": "127.0.0.1", "ports": [8080]},
+			"dest": {"ports": [80], "alias": "www"},
+			"limits": {"maxConns": 10, "idleTimeout": "30s", "maxLifetime": "1h", "dialTimeout": "5s"}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8080},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				alias:    "www",
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			limits: Limits{
+				MaxConns:    10,
+				IdleTimeout: 30 * time.Second,
+				MaxLifetime: time.Hour,
+				DialTimeout: 5 * time.Second,
+			},
+		}},
+	}, {
+		name: "import without limits",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [80]},
+			"dest": {"ports": [8000]}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "xxx.onion",
+				ports:    []int{80},
+				onion:    true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				dest:     true,
+				resolved: true,
+			},
+		}},
+	}, {
+		name: "import with retry",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [80]},
+			"dest": {"ports": [8000]},
+			"retry": {"deadline": "2m", "maxBackoff": "10s"},
+			"prewarm": true,
+			"isolation": "client",
+			"localTLS": {}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "xxx.onion",
+				ports:    []int{80},
+				onion:    true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				dest:     true,
+				resolved: true,
+			},
+			retry: Retry{
+				Deadline:       2 * time.Minute,
+				InitialBackoff: time.Second,
+				MaxBackoff:     10 * time.Second,
+			},
+			prewarm:  true,
+			isolate:  IsolateClient,
+			localTLS: &LocalTLS{},
+		}},
+	}, {
+		name: "export with retry",
+		in: `{"forwards": [{
+			"src": {"ports": [8080]},
+			"dest": {"ports": [80]},
+			"prewarm": true
+		}]}`,
+		readErr: `.*forward 0: retry, prewarm, isolation and TLS only apply to import forwards`,
+	}, {
+		name: "export with backends",
+		in: `{"forwards": [{
+			"backends": [
+				{"host": "127.0.0.1", "ports": [8001]},
+				{"host": "127.0.0.1", "ports": [8002]}
+			],
+			"dest": {"ports": [80]},
+			"balance": "least-conns",
+			"healthCheck": {"interval": "5s"}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8001},
+				resolved: true,
+			},
+			backends: []*Endpoint{{
+				host:     "127.0.0.1",
+				ports:    []int{8002},
+				resolved: true,
+			}},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			balance: LeastConns,
+			health: HealthCheck{
+				Type:     TCPCheck,
+				Interval: 5 * time.Second,
+				Timeout:  DefaultHealthTimeout,
+				Policy:   KeepPublished,
+			},
+		}},
+	}, {
+		name: "source and backends",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"backends": [{"ports": [8001]}],
+			"dest": {"ports": [80]}
+		}]}`,
+		readErr: `.*forward 0: forward may declare either a source or backends, not both`,
+	}, {
+		name: "onion backend",
+		in: `{"forwards": [{
+			"backends": [{"ports": [8001]}, {"host": "xxx.onion", "ports": [80]}],
+			"dest": {"ports": [80]}
+		}]}`,
+		readErr: `.*forward 0: forward backend 1: backends must be local`,
+	}, {
+		name: "invalid balance",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"balance": "random"
+		}]}`,
+		readErr: `.*forward 0: forward balance: invalid balance "random"`,
+	}, {
+		name: "export with proxy protocol",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80, 443]},
+			"proxyProtocol": "v2"
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80, 443},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			proxy: ProxyProtocolV2,
+		}},
+	}, {
+		name: "invalid proxy protocol",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"proxyProtocol": "v3"
+		}]}`,
+		readErr: `.*forward 0: forward: invalid proxy protocol "v3"`,
+	}, {
+		name: "import with proxy protocol",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [80]},
+			"dest": {"ports": [8000]},
+			"proxyProtocol": "v1"
+		}]}`,
+		readErr: `.*forward 0: backends, balance, health checks, proxy protocol, http and onion location only apply to export forwards`,
+	}, {
+		name: "invalid isolation",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [80]},
+			"dest": {"ports": [8000]},
+			"isolation": "total"
+		}]}`,
+		readErr: `.*forward 0: forward: invalid isolation "total"`,
+	}, {
+		name: "http export",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"type": "http",
+			"http": {
+				"host": "app.internal",
+				"headers": {"x-served-by": "onionpipe"},
+				"routes": [
+					{"path": "/api/", "backend": {"ports": [8001]}},
+					{"path": "/api/v2/", "backend": {"host": "127.0.0.2", "ports": [8002]}}
+				]
+			}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			typ: HTTPForward,
+			http: HTTPProxy{
+				Host:    "app.internal",
+				Headers: map[string]string{"X-Served-By": "onionpipe"},
+				Routes: []Route{{
+					Path: "/api/v2/",
+					Backend: &Endpoint{
+						host:     "127.0.0.2",
+						ports:    []int{8002},
+						resolved: true,
+					},
+				}, {
+					Path: "/api/",
+					Backend: &Endpoint{
+						host:     "127.0.0.1",
+						ports:    []int{8001},
+						resolved: true,
+					},
+				}},
+			},
+		}},
+	}, {
+		name: "http options without http type",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"http": {"host": "app.internal"}
+		}]}`,
+		readErr: `.*forward 0: forward: http options only apply to http forwards`,
+	}, {
+		name: "http with proxy protocol",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"type": "http",
+			"proxyProtocol": "v1"
+		}]}`,
+		readErr: `.*forward 0: forward: http forwards identify clients with X-Forwarded-For rather than proxy protocol`,
+	}, {
+		name: "invalid route",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"type": "http",
+			"http": {"routes": [{"path": "api", "backend": {"ports": [8001]}}]}
+		}]}`,
+		readErr: `.*forward 0: forward http: route 0: path "api" must start with "/"`,
+	}, {
+		name: "onion location",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80], "alias": "www"},
+			"onionLocation": {"listen": {"host": "0.0.0.0", "ports": [8080]}}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				alias:    "www",
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			onionLoc: OnionLocation{
+				Listen: &Endpoint{
+					host:     "0.0.0.0",
+					ports:    []int{8080},
+					resolved: true,
+				},
+			},
+		}},
+	}, {
+		name: "onion location on unix socket",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"onionLocation": {"listen": {"unix": "/run/site.sock"}}
+		}]}`,
+		readErr: `.*forward 0: forward onion location: listen address must be a local TCP address`,
+	}, {
+		name: "local TLS without key",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [80]},
+			"dest": {"ports": [8443]},
+			"localTLS": {"certFile": "cert.pem"}
+		}]}`,
+		readErr: `.*forward 0: forward local TLS: certFile and keyFile must be given together`,
+	}, {
+		name: "remote TLS",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [443]},
+			"dest": {"ports": [8080]},
+			"remoteTLS": {"fingerprint": "00:01:02:03:04:05:06:07:08:09:0a:0b:0c:0d:0e:0f:10:11:12:13:14:15:16:17:18:19:1a:1b:1c:1d:1e:1f"}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "xxx.onion",
+				ports:    []int{443},
+				onion:    true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8080},
+				dest:     true,
+				resolved: true,
+			},
+			remoteTLS: &RemoteTLS{Fingerprint: []byte{
+				0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+				16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+			}},
+		}},
+	}, {
+		name: "remote TLS without verification",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [443]},
+			"dest": {"ports": [8080]},
+			"remoteTLS": {"serverName": "xxx.onion"}
+		}]}`,
+		readErr: `.*forward 0: forward remote TLS: fingerprint or caFile is required to verify the onion`,
+	}, {
+		name: "remote TLS invalid fingerprint",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion", "ports": [443]},
+			"dest": {"ports": [8080]},
+			"remoteTLS": {"fingerprint": "abcd"}
+		}]}`,
+		readErr: `.*forward 0: forward remote TLS: invalid fingerprint "abcd": must be a hex SHA-256 digest`,
+	}, {
+		name: "access log",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"accessLog": {"format": "common", "file": "/var/log/onionpipe.log", "maxSize": "10M"}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			accessLog: AccessLog{
+				Format:     CommonLog,
+				File:       "/var/log/onionpipe.log",
+				MaxSize:    10 << 20,
+				MaxBackups: DefaultAccessLogBackups,
+			},
+		}},
+	}, {
+		name: "access log without backups",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"accessLog": {"file": "/var/log/onionpipe.log", "maxSize": "10M", "maxBackups": 0}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			accessLog: AccessLog{
+				Format:  JSONLog,
+				File:    "/var/log/onionpipe.log",
+				MaxSize: 10 << 20,
+			},
+		}},
+	}, {
+		name: "invalid access log format",
+		in: `{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80]},
+			"accessLog": {"format": "xml"}
+		}]}`,
+		readErr: `.*forward 0: forward access log: invalid access log format "xml"`,
+	}, {
+		name: "ipv6 source with address family",
+		in: `{"forwards": [{
+			"src": {"host": "::1", "ports": [8000], "family": "ipv6"},
+			"dest": {"ports": [80]}
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "::1",
+				ports:    []int{8000},
+				family:   PreferIPv6,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				dest:     true,
+				onion:    true,
+				resolved: true,
+			},
+		}},
+	}, {
+		name: "invalid address family",
+		in: `{"forwards": [{
+			"src": {"host": "localhost", "ports": [8000], "family": "ipx"},
+			"dest": {"ports": [80]}
+		}]}`,
+		readErr: `.*forward 0: forward source: invalid address family "ipx"`,
+	}, {
+		name: "port map",
+		in: `{"forwards": [{
+			"src": {"host": "192.168.1.100"},
+			"dest": {"alias": "web"},
+			"portMap": [{"src": 8443, "dest": 443}, {"src": 8080, "dest": 80}]
+		}]}`,
+		parsed: []*Forward{{
+			src: &Endpoint{
+				host:     "192.168.1.100",
+				ports:    []int{8443, 8080},
+				mapped:   true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{443, 80},
+				alias:    "web",
+				dest:     true,
+				onion:    true,
+				resolved: true,
+			},
+		}},
+	}, {
+		name: "port map with ports",
+		in: `{"forwards": [{
+			"src": {"ports": [8443]},
+			"dest": {},
+			"portMap": [{"src": 8443, "dest": 443}]
+		}]}`,
+		readErr: `.*forward 0: forward may declare either a port map or source and destination ports, not both`,
+	}, {
+		name: "port map duplicate",
+		in: `{"forwards": [{
+			"src": {},
+			"dest": {},
+			"portMap": [{"src": 8443, "dest": 443}, {"src": 8444, "dest": 443}]
+		}]}`,
+		readErr: `.*forward 0: forward port map: duplicate port 443`,
+	}, {
+		name: "port map of onion",
+		in: `{"forwards": [{
+			"src": {"host": "xxx.onion"},
+			"dest": {},
+			"portMap": [{"src": 80, "dest": 8080}]
+		}]}`,
+		readErr: `.*forward 0: forward: port maps only apply to export forwards`,
+	}, {
+		name: "invalid duration",
+		in: `{"forwards": [{
+			"src": {"ports": [8080]},
+			"dest": {"ports": [80]},
+			"limits": {"idleTimeout": "soon"}
+		}]}`,
+		readErr: `.*forward 0: forward limits: invalid idleTimeout: .*`,
+	}, {
+		name: "negative limit",
+		in: `{"forwards": [{
+			"src": {"ports": [8080]},
+			"dest": {"ports": [80]},
+			"limits": {"maxConns": -1}
+		}]}`,
+		readErr: `.*forward 0: forward limits: invalid maxConns -1`,
+	}, {
+		name:    "unknown field",
+		in:      `{"forwardz": []}`,
+		readErr: `.*unknown field "forwardz"`,
+	}}
+	for i, test := range tests {
+		c.Run(fmt.Sprintf("%d %s", i, test.name), func(c *qt.C) {
+			path := filepath.Join(c.Mkdir(), "onionpipe.json")
+			err := os.WriteFile(path, []byte(test.in), 0600)
+			c.Assert(err, qt.IsNil)
+			fwds, err := ReadFile(path)
+			if test.readErr != "" {
+				c.Check(err, qt.ErrorMatches, test.readErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(fwds, qt.CmpEquals(cmp.AllowUnexported(Forward{}, Endpoint{})), test.parsed)
+		})
+	}
+
+	c.Run("missing file", func(c *qt.C) {
+		_, err := ReadFile(filepath.Join(c.Mkdir(), "nope.json"))
+		c.Assert(err, qt.Not(qt.IsNil))
+		c.Assert(strings.Contains(err.Error(), "nope.json"), qt.IsTrue)
+	})
+
+	c.Run("environment variables", func(c *qt.C) {
+		c.Setenv("ONIONPIPE_TEST_ALIAS", `my "app"`)
+		path := filepath.Join(c.Mkdir(), "onionpipe.json")
+		err := os.WriteFile(path, []byte(`{"forwards": [{
+			"src": {"ports": [8000]},
+			"dest": {"ports": [80], "alias": "${ONIONPIPE_TEST_ALIAS}"}
+		}]}`), 0600)
+		c.Assert(err, qt.IsNil)
+		fwds, err := ReadFile(path)
+		c.Assert(err, qt.IsNil)
+		c.Assert(fwds, qt.HasLen, 1)
+		c.Assert(fwds[0].Destination().Alias(), qt.Equals, `my "app"`)
+
+		err = os.WriteFile(path, []byte(`{"forwards": [{
+			"src": {"host": "${ONIONPIPE_TEST_UNDEFINED}", "ports": [8000]},
+			"dest": {"ports": [80]}
+		}]}`), 0600)
+		c.Assert(err, qt.IsNil)
+		_, err = ReadFile(path)
+		c.Assert(err, qt.ErrorMatches, `.*: undefined variable "ONIONPIPE_TEST_UNDEFINED"`)
+	})
+}
+
+func TestWriteFile(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	path := filepath.Join(dir, "onionpipe.json")
+	err := os.WriteFile(path, []byte(`{"forwards": [{
+		"backends": [{"host": "127.0.0.1", "ports": [8000]}, {"host": "::1", "ports": [8001], "family": "ipv6"}],
+		"dest": {"ports": [80, 443], "alias": "web"},
+		"balance": "least-conns",
+		"healthCheck": {"type": "http", "path": "/health", "policy": "unavailable"},
+		"limits": {"maxConns": 10, "idleTimeout": "5m", "rate": "1M", "connRate": "1536"},
+		"type": "http",
+		"http": {
+			"host": "example.com",
+			"headers": {"x-test": "yes"},
+			"routes": [{"path": "/api/", "backend": {"host": "127.0.0.1", "ports": [9000]}}]
+		},
+		"onionLocation": {"listen": {"host": "127.0.0.1", "ports": [8080]}},
+		"accessLog": {"format": "common", "file": "access.log", "maxSize": "10M", "maxBackups": 0}
+	}, {
+		"src": {"host": "xxx.onion", "ports": [443]},
+		"dest": {"host": "127.0.0.1", "ports": [8443]},
+		"retry": {"deadline": "2m"},
+		"prewarm": true,
+		"isolation": "client",
+		"localTLS": {},
+		"remoteTLS": {"serverName": "example.com", "fingerprint": "`+strings.Repeat("ab:", 31)+`ab"}
+	}, {
+		"src": {"host": "127.0.0.1"},
+		"dest": {},
+		"portMap": [{"src": 8443, "dest": 443}, {"src": 8080, "dest": 80}]
+	}]}`), 0600)
+	c.Assert(err, qt.IsNil)
+	fwds, err := ReadFile(path)
+	c.Assert(err, qt.IsNil)
+
+	written := filepath.Join(dir, "written.json")
+	c.Assert(WriteFile(written, fwds), qt.IsNil)
+	if runtime.GOOS != "windows" {
+		st, err := os.Stat(written)
+		c.Assert(err, qt.IsNil)
+		c.Assert(st.Mode().Perm(), qt.Equals, os.FileMode(0600))
+	}
+	reread, err := ReadFile(written)
+	c.Assert(err, qt.IsNil)
+	c.Assert(reread, qt.CmpEquals(cmp.AllowUnexported(Forward{}, Endpoint{})), fwds)
+
+	// Writing is stable once normalized.
+	var first, second bytes.Buffer
+	c.Assert(write(&first, fwds), qt.IsNil)
+	c.Assert(write(&second, reread), qt.IsNil)
+	c.Assert(second.String(), qt.Equals, first.String())
+	c.Assert(first.String(), qt.Contains, `"portMap": [`)
+	c.Assert(first.String(), qt.Not(qt.Contains), `"limits": {}`)
+}
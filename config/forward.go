@@ -2,14 +2,31 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"regexp"
 	"strings"
 )
 
 // Forward defines a network forwarding relay from a source endpoint to a
 // destination endpoint.
 type Forward struct {
-	src  *Endpoint
-	dest *Endpoint
+	src       *Endpoint
+	dest      *Endpoint
+	backends  []*Endpoint
+	balance   Balance
+	health    HealthCheck
+	proxy     ProxyProtocol
+	limits    Limits
+	retry     Retry
+	prewarm   bool
+	isolate   Isolation
+	typ       ForwardType
+	http      HTTPProxy
+	onionLoc  OnionLocation
+	localTLS  *LocalTLS
+	remoteTLS *RemoteTLS
+	accessLog AccessLog
 }
 
 // IsImport returns whether the forward is importing an onion to a local
@@ -18,30 +35,232 @@ func (f *Forward) IsImport() bool {
 	return f.src.onion
 }
 
-// Source returns the source endpoint in the forwarding relay.
+// Source returns the source endpoint in the forwarding relay. If an export
+// has several backends, this is the first of them.
 func (f *Forward) Source() *Endpoint {
 	return f.src
 }
 
+// Backends returns all of the source endpoints that an export forward may
+// connect to. This is just the source, unless several backends are declared.
+func (f *Forward) Backends() []*Endpoint {
+	return append([]*Endpoint{f.src}, f.backends...)
+}
+
+// Warnings returns the problems found resolving the forward's endpoints which
+// do not stop it from being used.
+func (f *Forward) Warnings() []error {
+	endps := append(f.Backends(), f.dest)
+	for _, route := range f.http.Routes {
+		endps = append(endps, route.Backend)
+	}
+	if f.onionLoc.Backend != nil {
+		endps = append(endps, f.onionLoc.Backend)
+	}
+	var warnings []error
+	for _, endp := range endps {
+		if err := endp.Warning(); err != nil {
+			warnings = append(warnings, err)
+		}
+	}
+	return warnings
+}
+
+// Balance returns how connections are distributed among an export's
+// backends.
+func (f *Forward) Balance() Balance {
+	if f.balance == "" {
+		return RoundRobin
+	}
+	return f.balance
+}
+
+// HealthCheck returns how an export's backends are checked for health.
+func (f *Forward) HealthCheck() HealthCheck {
+	return f.health
+}
+
+// ProxyProtocol returns which PROXY protocol header, if any, is sent to an
+// export's backends.
+func (f *Forward) ProxyProtocol() ProxyProtocol {
+	return f.proxy
+}
+
+// LocalTLS returns the TLS termination of an import's local destination, or
+// nil if connections are not encrypted.
+func (f *Forward) LocalTLS() *LocalTLS {
+	return f.localTLS
+}
+
+// SetLocalTLS sets the TLS termination of an import's local destination.
+func (f *Forward) SetLocalTLS(localTLS *LocalTLS) {
+	f.localTLS = localTLS
+}
+
+// RemoteTLS returns the TLS origination from an import to its onion, or nil
+// if connections to the onion are not encrypted.
+func (f *Forward) RemoteTLS() *RemoteTLS {
+	return f.remoteTLS
+}
+
+// SetRemoteTLS sets the TLS origination from an import to its onion.
+func (f *Forward) SetRemoteTLS(remoteTLS *RemoteTLS) {
+	f.remoteTLS = remoteTLS
+}
+
+// AccessLog returns the forward's access log configuration.
+func (f *Forward) AccessLog() AccessLog {
+	return f.accessLog
+}
+
+// SetAccessLog sets the forward's access log configuration.
+func (f *Forward) SetAccessLog(accessLog AccessLog) {
+	f.accessLog = accessLog
+}
+
+// Type returns the protocol relayed by the forward.
+func (f *Forward) Type() ForwardType {
+	if f.typ == "" {
+		return TCPForward
+	}
+	return f.typ
+}
+
+// HTTPProxy returns the reverse proxy configuration of an http export.
+func (f *Forward) HTTPProxy() HTTPProxy {
+	return f.http
+}
+
+// OnionLocation returns the export's Onion-Location proxy configuration.
+func (f *Forward) OnionLocation() OnionLocation {
+	return f.onionLoc
+}
+
 // Destination returns the destination endpoint in the forwarding relay.
 func (f *Forward) Destination() *Endpoint {
 	return f.dest
 }
 
+// Limits returns the connection limits applied to the forward.
+func (f *Forward) Limits() Limits {
+	return f.limits
+}
+
+// SetLimits sets the connection limits applied to the forward.
+func (f *Forward) SetLimits(limits Limits) {
+	f.limits = limits
+}
+
+// Retry returns how failed dials to an imported onion are retried.
+func (f *Forward) Retry() Retry {
+	return f.retry
+}
+
+// SetRetry sets how failed dials to an imported onion are retried.
+func (f *Forward) SetRetry(retry Retry) {
+	f.retry = retry
+}
+
+// Prewarm returns whether an imported onion should be connected to when the
+// forward starts, so that its descriptor is fetched and a circuit is built
+// before the first local connection needs it.
+func (f *Forward) Prewarm() bool {
+	return f.prewarm
+}
+
+// SetPrewarm sets whether an imported onion should be connected to when the
+// forward starts.
+func (f *Forward) SetPrewarm(prewarm bool) {
+	f.prewarm = prewarm
+}
+
+// Isolation returns which connections through an import forward may share
+// Tor circuits.
+func (f *Forward) Isolation() Isolation {
+	if f.isolate == "" {
+		return NoIsolation
+	}
+	return f.isolate
+}
+
+// SetIsolation sets which connections through an import forward may share
+// Tor circuits.
+func (f *Forward) SetIsolation(isolate Isolation) {
+	f.isolate = isolate
+}
+
 // ForwardDoc defines a JSON representation of a forward.
+//
+// An export may declare several local backends instead of a single source.
 type ForwardDoc struct {
-	Src  EndpointDoc `json:"src"`
-	Dest EndpointDoc `json:"dest"`
+	Src         EndpointDoc     `json:"src"`
+	Dest        EndpointDoc     `json:"dest"`
+	Backends    []EndpointDoc   `json:"backends,omitempty"`
+	Balance     string          `json:"balance,omitempty"`
+	HealthCheck *HealthCheckDoc `json:"healthCheck,omitempty"`
+	ProxyProto  string          `json:"proxyProtocol,omitempty"`
+	Limits      *LimitsDoc      `json:"limits,omitempty"`
+	Retry       *RetryDoc       `json:"retry,omitempty"`
+	Prewarm     bool            `json:"prewarm,omitempty"`
+	Isolation   string          `json:"isolation,omitempty"`
+	Type        string          `json:"type,omitempty"`
+	HTTP        *HTTPProxyDoc   `json:"http,omitempty"`
+
+	OnionLocation *OnionLocationDoc `json:"onionLocation,omitempty"`
+	LocalTLS      *LocalTLSDoc      `json:"localTLS,omitempty"`
+	RemoteTLS     *RemoteTLSDoc     `json:"remoteTLS,omitempty"`
+	AccessLog     *AccessLogDoc     `json:"accessLog,omitempty"`
+
+	// PortMap maps several local ports of an export's source onto onion
+	// ports, in place of the source and destination ports.
+	PortMap []PortMapDoc `json:"portMap,omitempty"`
+}
+
+// PortMapDoc defines a JSON representation of a local port forwarded to an
+// onion port.
+type PortMapDoc struct {
+	Src  int `json:"src"`
+	Dest int `json:"dest"`
 }
 
 // Forward returns a validated and resolved Forward from a JSON document object
 // model.
 func (d *ForwardDoc) Forward() (*Forward, error) {
-	ig, err := d.Src.Endpoint(false, IsOnionHost(d.Src.Host))
+	srcDoc, destDoc, backendDocs := d.Src, d.Dest, d.Backends
+	if len(backendDocs) > 0 {
+		if d.Src.Host != "" || len(d.Src.Ports) > 0 || d.Src.Path != "" || d.Src.Alias != "" {
+			return nil, fmt.Errorf("forward may declare either a source or backends, not both")
+		}
+		if len(d.PortMap) > 0 {
+			return nil, fmt.Errorf("forward may declare either a port map or backends, not both")
+		}
+		srcDoc, backendDocs = backendDocs[0], backendDocs[1:]
+	}
+	mapped := len(d.PortMap) > 0
+	if mapped {
+		if IsOnionHost(srcDoc.Host) {
+			return nil, fmt.Errorf("forward: port maps only apply to export forwards")
+		}
+		if len(srcDoc.Ports) > 0 || len(destDoc.Ports) > 0 {
+			return nil, fmt.Errorf("forward may declare either a port map or source and destination ports, not both")
+		}
+		srcDoc.Ports, destDoc.Ports = nil, nil
+		for _, pm := range d.PortMap {
+			srcDoc.Ports = append(srcDoc.Ports, pm.Src)
+			destDoc.Ports = append(destDoc.Ports, pm.Dest)
+		}
+		if err := checkPortList(srcDoc.Ports); err != nil {
+			return nil, fmt.Errorf("forward port map: %w", err)
+		}
+		if err := checkPortList(destDoc.Ports); err != nil {
+			return nil, fmt.Errorf("forward port map: %w", err)
+		}
+	}
+	ig, err := srcDoc.endpoint(false, IsOnionHost(srcDoc.Host), mapped)
 	if err != nil {
 		return nil, fmt.Errorf("forward source: %w", err)
 	}
-	eg, err := d.Dest.Endpoint(true, !IsOnionHost(d.Src.Host))
+	eg, err := destDoc.Endpoint(true, !IsOnionHost(srcDoc.Host))
 	if err != nil {
 		return nil, fmt.Errorf("forward destination: %w", err)
 	}
@@ -49,10 +268,104 @@ func (d *ForwardDoc) Forward() (*Forward, error) {
 		src:  ig,
 		dest: eg,
 	}
+	for i := range backendDocs {
+		if IsOnionHost(backendDocs[i].Host) {
+			return nil, fmt.Errorf("forward backend %d: backends must be local", i+1)
+		}
+		backend, err := backendDocs[i].Endpoint(false, false)
+		if err != nil {
+			return nil, fmt.Errorf("forward backend %d: %w", i+1, err)
+		}
+		f.backends = append(f.backends, backend)
+	}
+	if d.Balance != "" {
+		f.balance, err = ParseBalance(d.Balance)
+		if err != nil {
+			return nil, fmt.Errorf("forward balance: %w", err)
+		}
+	}
+	if d.HealthCheck != nil {
+		f.health, err = d.HealthCheck.HealthCheck()
+		if err != nil {
+			return nil, fmt.Errorf("forward health check: %w", err)
+		}
+	}
+	f.proxy, err = ParseProxyProtocol(d.ProxyProto)
+	if err != nil {
+		return nil, fmt.Errorf("forward: %w", err)
+	}
+	if d.Limits != nil {
+		f.limits, err = d.Limits.Limits()
+		if err != nil {
+			return nil, fmt.Errorf("forward limits: %w", err)
+		}
+	}
+	if d.AccessLog != nil {
+		f.accessLog, err = d.AccessLog.AccessLog()
+		if err != nil {
+			return nil, fmt.Errorf("forward access log: %w", err)
+		}
+	}
+	if d.Retry != nil {
+		f.retry, err = d.Retry.Retry()
+		if err != nil {
+			return nil, fmt.Errorf("forward retry: %w", err)
+		}
+	}
+	f.prewarm = d.Prewarm
+	if d.Isolation != "" {
+		f.isolate, err = ParseIsolation(d.Isolation)
+		if err != nil {
+			return nil, fmt.Errorf("forward: %w", err)
+		}
+	}
+	if d.Type != "" {
+		f.typ, err = ParseForwardType(d.Type)
+		if err != nil {
+			return nil, fmt.Errorf("forward: %w", err)
+		}
+	}
+	if d.HTTP != nil {
+		if f.typ != HTTPForward {
+			return nil, fmt.Errorf("forward: http options only apply to http forwards")
+		}
+		f.http, err = d.HTTP.HTTPProxy()
+		if err != nil {
+			return nil, fmt.Errorf("forward http: %w", err)
+		}
+	}
+	if d.LocalTLS != nil {
+		f.localTLS, err = d.LocalTLS.LocalTLS()
+		if err != nil {
+			return nil, fmt.Errorf("forward local TLS: %w", err)
+		}
+	}
+	if d.RemoteTLS != nil {
+		f.remoteTLS, err = d.RemoteTLS.RemoteTLS()
+		if err != nil {
+			return nil, fmt.Errorf("forward remote TLS: %w", err)
+		}
+	}
+	if d.OnionLocation != nil {
+		f.onionLoc, err = d.OnionLocation.OnionLocation()
+		if err != nil {
+			return nil, fmt.Errorf("forward onion location: %w", err)
+		}
+	}
+	if f.typ == HTTPForward && f.proxy != NoProxyProtocol {
+		return nil, fmt.Errorf("forward: http forwards identify clients with X-Forwarded-For rather than proxy protocol")
+	}
 	err = f.Resolve()
 	if err != nil {
 		return nil, err
 	}
+	if !f.IsImport() && (f.retry != Retry{} || f.prewarm || f.isolate != "" || f.localTLS != nil || f.remoteTLS != nil) {
+		return nil, fmt.Errorf("retry, prewarm, isolation and TLS only apply to import forwards")
+	}
+	if f.IsImport() && (len(d.Backends) > 0 || f.balance != "" || !f.health.IsZero() || f.proxy != NoProxyProtocol ||
+		f.typ == HTTPForward || !f.onionLoc.IsZero()) {
+		return nil, fmt.Errorf("backends, balance, health checks, proxy protocol, http and onion location only apply to export forwards")
+	}
 	return f, nil
 }
 
@@ -60,16 +373,156 @@ func (d *ForwardDoc) Forward() (*Forward, error) {
 // destination is an onion, a mapping of alias to remote onion ID may be
 // provided, to render the assigned onion address.
 func (f *Forward) Description(remoteOnions map[string]string) string {
-	return fmt.Sprintf("%s => %s", f.src.Description(nil), f.dest.Description(remoteOnions))
+	var srcs []string
+	for _, backend := range f.Backends() {
+		srcs = append(srcs, backend.Description(nil))
+	}
+	return fmt.Sprintf("%s => %s", strings.Join(srcs, ","), f.dest.Description(remoteOnions))
 }
 
-// ParseForward returns a new Forward parsed from a string representation
-func ParseForward(s string) (*Forward, error) {
+// String returns a canonical forward expression, which ParseForward parses
+// into an equivalent forward. Expressions only describe the source and
+// destination; Doc also represents backends and other options. An import
+// with client authorization is expressed with an onion URL source, unless it
+// is given as a private key, which is left out so that it is not disclosed in
+// logs and output.
+func (f *Forward) String() string {
+	var alias string
+	if f.dest.alias != "" {
+		alias = "@" + f.dest.alias
+	}
+	if f.src.mapped {
+		return net.JoinHostPort(f.src.HostName(), formatPortMap(f.src.ports, f.dest.ports)) + alias
+	}
+	src := f.src.configuredAddr()
+	if auth := f.src.authName(); auth != "" {
+		src = onionScheme + "://" + src + "?" + url.Values{"auth": {auth}}.Encode()
+	}
+	dest := formatPortList(f.dest.ports)
+	if !f.dest.onion {
+		dest = f.dest.configuredAddr()
+	}
+	return src + "~" + dest + alias
+}
+
+// Doc returns a JSON document object model of the forward, from which
+// ForwardDoc.Forward returns an equivalent forward. Service keys are not
+// included.
+func (f *Forward) Doc() *ForwardDoc {
+	d := &ForwardDoc{
+		Src:        f.src.Doc(),
+		Dest:       f.dest.Doc(),
+		Balance:    string(f.balance),
+		ProxyProto: string(f.proxy),
+		Prewarm:    f.prewarm,
+		Isolation:  string(f.isolate),
+		Type:       string(f.typ),
+	}
+	if len(f.backends) > 0 {
+		d.Src = EndpointDoc{}
+		for _, backend := range f.Backends() {
+			d.Backends = append(d.Backends, backend.Doc())
+		}
+	}
+	if f.src.mapped {
+		d.Src.Ports, d.Dest.Ports = nil, nil
+		for i := range f.src.ports {
+			d.PortMap = append(d.PortMap, PortMapDoc{Src: f.src.ports[i], Dest: f.dest.ports[i]})
+		}
+	}
+	if !f.health.IsZero() {
+		d.HealthCheck = f.health.Doc()
+	}
+	if !f.limits.IsZero() {
+		d.Limits = f.limits.Doc()
+	}
+	if f.retry != (Retry{}) {
+		d.Retry = f.retry.Doc()
+	}
+	if !f.http.IsZero() {
+		d.HTTP = f.http.Doc()
+	}
+	if !f.onionLoc.IsZero() {
+		d.OnionLocation = f.onionLoc.Doc()
+	}
+	if f.localTLS != nil {
+		d.LocalTLS = f.localTLS.Doc()
+	}
+	if f.remoteTLS != nil {
+		d.RemoteTLS = f.remoteTLS.Doc()
+	}
+	if !f.accessLog.IsZero() {
+		d.AccessLog = f.accessLog.Doc()
+	}
+	return d
+}
+
+// ParseOption is an option that configures how a forward is parsed.
+type ParseOption func(f *Forward)
+
+// PreferAddressFamily resolves host names in the forward to addresses of the
+// given family, where available.
+func PreferAddressFamily(family AddressFamily) ParseOption {
+	return func(f *Forward) {
+		f.src.family = family
+		f.dest.family = family
+	}
+}
+
+// ResolveSource sets when the host name of an export's source is resolved.
+// It has no effect on imports or UNIX socket sources.
+func ResolveSource(resolution Resolution) ParseOption {
+	return func(f *Forward) {
+		if f.src.path == "" && !IsOnionHost(f.src.host) {
+			f.src.resolution = resolution
+		}
+	}
+}
+
+// LookupContacts resolves the source of an import through an address book,
+// which returns the onion ID and client authorization, if any, of a contact
+// name. A contact is named in an onion URL source, as in onion://contact:80,
+// so that it cannot be mistaken for a local host name. Client authorization
+// given in the source takes precedence over the contact's.
+//
+// Forward documents are not looked up, as configuration files give the onion
+// addresses of their imports.
+func LookupContacts(lookup func(name string) (onionID, auth string, ok bool)) ParseOption {
+	return func(f *Forward) {
+		name := f.src.alias
+		if !f.src.onion || name == "" {
+			return
+		}
+		if onionID, auth, ok := lookup(name); ok {
+			f.src.host, f.src.alias = onionID+".onion", ""
+			if f.src.auth == "" {
+				f.src.auth = auth
+			}
+		}
+	}
+}
+
+// ParseForward returns a new Forward parsed from a string representation,
+// after expanding ${VAR} environment variable references.
+func ParseForward(s string, options ...ParseOption) (*Forward, error) {
+	s, err := ExpandEnv(s)
+	if err != nil {
+		return nil, err
+	}
 	parts := strings.SplitN(s, "~", 2)
 	var src, dest *Endpoint
-	var err error
-	switch len(parts) {
-	case 1:
+	switch {
+	case len(parts) == 1 && isPortMap(s) && !isEndpointURL(s):
+		src, dest, err = parsePortMap(s)
+		if err != nil {
+			return nil, err
+		}
+	case len(parts) == 1 && isEndpointURL(s):
+		src, dest, err = parseURLExport(s)
+		if err != nil {
+			return nil, err
+		}
+	case len(parts) == 1:
 		src, err = ParseEndpoint(parts[0], false)
 		if err != nil {
 			return nil, fmt.Errorf("forward source: %w", err)
@@ -78,7 +531,7 @@ func ParseForward(s string) (*Forward, error) {
 		if err != nil {
 			return nil, fmt.Errorf("forward destination: %w", err)
 		}
-	case 2:
+	case len(parts) == 2:
 		src, err = ParseEndpoint(parts[0], false)
 		if err != nil {
 			return nil, fmt.Errorf("forward source: %w", err)
@@ -91,9 +544,18 @@ func ParseForward(s string) (*Forward, error) {
 		return nil, fmt.Errorf("invalid forward %q", s)
 	}
 
+	if !src.limits.IsZero() && !dest.limits.IsZero() {
+		return nil, fmt.Errorf("invalid forward %q: timeouts may be given on the source or the destination, not both", s)
+	}
 	f := &Forward{
-		src:  src,
-		dest: dest,
+		src:    src,
+		dest:   dest,
+		limits: src.limits.Merge(dest.limits),
+	}
+	// The forward's limits are the only ones which apply from here on.
+	src.limits, dest.limits = Limits{}, Limits{}
+	for i := range options {
+		options[i](f)
 	}
 	err = f.Resolve()
 	if err != nil {
@@ -102,6 +564,85 @@ func ParseForward(s string) (*Forward, error) {
 	return f, nil
 }
 
+// parseURLExport parses a forward given as a single endpoint URL, which
+// exports a local network address on the same onion ports, as a single port
+// or range does in short form.
+func parseURLExport(s string) (src, dest *Endpoint, err error) {
+	src, err = ParseEndpoint(s, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("forward source: %w", err)
+	}
+	if src.path != "" || src.onion {
+		return nil, nil, fmt.Errorf("invalid forward %q: a destination must be given, as in %s~DEST", s, s)
+	}
+	return src, &Endpoint{ports: src.ports, dest: true}, nil
+}
+
+// portMapRE matches the mappings of a port map, the first of which must map a
+// port or range.
+var portMapRE = regexp.MustCompile(`^[\d-]+=[\w-]+(,[\w-]+(=[\w-]+)?)*$`)
+
+// isPortMap returns whether a forward is a port map, by the form of the
+// mappings between its host, if any, and its alias, if any. Other uses of
+// "=", as in the path of a UNIX socket, are not port maps.
+func isPortMap(s string) bool {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		s = s[i+1:]
+	}
+	return portMapRE.MatchString(s)
+}
+
+// parsePortMap parses a forward which maps local ports onto onion ports, such
+// as 192.168.1.100:8443=443,8080=80@alias. Either side of each mapping may be a
+// port range.
+func parsePortMap(s string) (src, dest *Endpoint, err error) {
+	var alias string
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s, alias = s[:i], s[i+1:]
+	}
+	var host string
+	if strings.Contains(s, ":") {
+		host, s, err = splitHostPort(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		if IsOnionHost(host) {
+			return nil, nil, fmt.Errorf("port maps only apply to export forwards")
+		}
+	}
+	var srcPorts, destPorts []int
+	for _, mapping := range strings.Split(s, ",") {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok || strings.Contains(to, "=") {
+			return nil, nil, fmt.Errorf("invalid port mapping %q", mapping)
+		}
+		fromPorts, err := parsePortList(from)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid port mapping %q: %w", mapping, err)
+		}
+		toPorts, err := parsePortList(to)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid port mapping %q: %w", mapping, err)
+		}
+		if len(fromPorts) != len(toPorts) {
+			return nil, nil, fmt.Errorf("invalid port mapping %q: maps %d ports onto %d", mapping, len(fromPorts), len(toPorts))
+		}
+		srcPorts, destPorts = append(srcPorts, fromPorts...), append(destPorts, toPorts...)
+	}
+	if err := checkPortList(srcPorts); err != nil {
+		return nil, nil, fmt.Errorf("forward source: %w", err)
+	}
+	if err := checkPortList(destPorts); err != nil {
+		return nil, nil, fmt.Errorf("forward destination: %w", err)
+	}
+	src = &Endpoint{host: host, ports: srcPorts, mapped: len(srcPorts) > 1}
+	dest = &Endpoint{ports: destPorts, dest: true, alias: alias}
+	return src, dest, nil
+}
+
 // Resolve validates the endpoints of the forward and whether together they
 // constitute a valid, well-formed and supported forwarding arrangement.
 func (f *Forward) Resolve() error {
@@ -122,5 +663,9 @@ func (f *Forward) Resolve() error {
 	if f.src.onion == f.dest.onion {
 		return fmt.Errorf("source or destination must be an onion address")
 	}
+	if n := len(f.src.ports); n > 1 && n != len(f.dest.ports) {
+		return fmt.Errorf("source ports %s map one-to-one onto destination ports, but %d destination ports are given",
+			formatPortList(f.src.ports), len(f.dest.ports))
+	}
 	return nil
 }
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp"
@@ -19,6 +21,10 @@ func TestForward(t *testing.T) {
 	ln, err := net.Listen("unix", socketPath)
 	c.Assert(err, qt.IsNil)
 	c.Cleanup(func() { c.Assert(ln.Close(), qt.IsNil) })
+	eqSocketPath := filepath.Join(socketDir, "a=b.sock")
+	eqLn, err := net.Listen("unix", eqSocketPath)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { c.Assert(eqLn.Close(), qt.IsNil) })
 
 	tests := []struct {
 		name     string
@@ -80,6 +86,7 @@ func TestForward(t *testing.T) {
 		parsed: &Forward{
 			src: &Endpoint{
 				host:     "127.0.0.1",
+				name:     "localhost",
 				ports:    []int{8080},
 				resolved: true,
 			},
@@ -121,6 +128,21 @@ func TestForward(t *testing.T) {
 				resolved: true,
 			},
 		},
+	}, {
+		name: "unix addr with = in path",
+		in:   eqSocketPath + "~80",
+		parsed: &Forward{
+			src: &Endpoint{
+				path:     eqSocketPath,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
 	}, {
 		name: "onion to local net",
 		in:   "xxx.onion:80~8000",
@@ -154,6 +176,208 @@ func TestForward(t *testing.T) {
 				resolved: true,
 			},
 		},
+	}, {
+		name: "ipv6 local net addr, mapped",
+		in:   "[::1]:8000~80",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "::1",
+				ports:    []int{8000},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "onion to ipv6 local net",
+		in:   "xxx.onion:80~[0:0::1]:8000",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "xxx.onion",
+				ports:    []int{80},
+				onion:    true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				host:     "::1",
+				ports:    []int{8000},
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "port range, mapped",
+		in:   "127.0.0.1:9000-9002~10000-10002@svc",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{9000, 9001, 9002},
+				mapped:   true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{10000, 10001, 10002},
+				alias:    "svc",
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "port range",
+		in:   "9000-9001",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{9000, 9001},
+				mapped:   true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{9000, 9001},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "port map",
+		in:   "192.168.1.100:8443=443,8080=80",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "192.168.1.100",
+				ports:    []int{8443, 8080},
+				mapped:   true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{443, 80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "port map with ranges, aliased",
+		in:   "[::1]:8443=443,9000-9001=10000-10001@svc",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "::1",
+				ports:    []int{8443, 9000, 9001},
+				mapped:   true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{443, 10000, 10001},
+				alias:    "svc",
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "port map, local host",
+		in:   "8080=80",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8080},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "url export",
+		in:   "tcp://10.1.1.1:8080?family=ipv6~onion://web:80,443",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "10.1.1.1",
+				ports:    []int{8080},
+				family:   PreferIPv6,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80, 443},
+				alias:    "web",
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "url unix export",
+		in:   "unix://" + socketPath + "~onion://:80",
+		parsed: &Forward{
+			src: &Endpoint{
+				path:     socketPath,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "url import",
+		in:   "onion://xxx.onion:80~tcp://:8080",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "xxx.onion",
+				ports:    []int{80},
+				onion:    true,
+				resolved: true,
+			},
+			dest: &Endpoint{
+				host:     "127.0.0.1",
+				ports:    []int{8080},
+				dest:     true,
+				resolved: true,
+			},
+		},
+	}, {
+		name: "url timeouts",
+		in:   "tcp://10.1.1.1:8080?dialTimeout=5s&idleTimeout=1m~80",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "10.1.1.1",
+				ports:    []int{8080},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{80},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+			limits: Limits{DialTimeout: 5 * time.Second, IdleTimeout: time.Minute},
+		},
+	}, {
+		name: "url export without destination",
+		in:   "tcp://10.1.1.1:8080",
+		parsed: &Forward{
+			src: &Endpoint{
+				host:     "10.1.1.1",
+				ports:    []int{8080},
+				resolved: true,
+			},
+			dest: &Endpoint{
+				ports:    []int{8080},
+				onion:    true,
+				dest:     true,
+				resolved: true,
+			},
+		},
 	}, {
 		/* Semantically invalid forwards */
 		name:     "multi port",
@@ -163,6 +387,78 @@ func TestForward(t *testing.T) {
 		name:     "multi multi",
 		in:       "80,81,82~80,8080,8888",
 		parseErr: `.*: local network address may only specify a single port`,
+	}, {
+		name:     "mismatched port range",
+		in:       "9000-9002~80,443",
+		parseErr: `source ports 9000-9002 map one-to-one onto destination ports, but 2 destination ports are given`,
+	}, {
+		name:     "port range to local",
+		in:       "xxx.onion:80~9000-9001",
+		parseErr: `.*: local network address may only specify a single port`,
+	}, {
+		name:     "port map length mismatch",
+		in:       "9000-9002=80,443",
+		parseErr: `invalid port mapping "9000-9002=80": maps 3 ports onto 1`,
+	}, {
+		name:     "port map range length mismatch",
+		in:       "9000-9002=80-81",
+		parseErr: `invalid port mapping "9000-9002=80-81": maps 3 ports onto 2`,
+	}, {
+		name:     "port map duplicate onion port",
+		in:       "8080=80,8081=80",
+		parseErr: `forward destination: duplicate port 80`,
+	}, {
+		name:     "port map duplicate local port",
+		in:       "8080=80,8080=81",
+		parseErr: `forward source: duplicate port 8080`,
+	}, {
+		name:     "port map invalid port",
+		in:       "8080=http",
+		parseErr: `invalid port mapping "8080=http": invalid port number "http"`,
+	}, {
+		name:     "unix addr with = in path without destination",
+		in:       eqSocketPath,
+		parseErr: `forward destination: invalid onion endpoint`,
+	}, {
+		name:     "port map of onion",
+		in:       "xxx.onion:80=8080",
+		parseErr: `port maps only apply to export forwards`,
+	}, {
+		name:     "url onion to local",
+		in:       "onion://xxx.onion:80~onion://:8080",
+		parseErr: `forward destination: onion endpoint must be an onion address to import, or the ports of an export`,
+	}, {
+		name:     "url unix socket does not exist",
+		in:       "unix://not-yet.sock~80",
+		parseErr: `forward source: stat not-yet.sock: no such file or directory`,
+	}, {
+		name:     "url unknown scheme",
+		in:       "udp://10.1.1.1:53~53",
+		parseErr: `forward source: invalid endpoint "udp://10.1.1.1:53": unsupported scheme "udp"`,
+	}, {
+		name:     "url unknown option",
+		in:       "tcp://10.1.1.1:8080?retries=3~80",
+		parseErr: `forward source: invalid endpoint "tcp://10.1.1.1:8080\?retries=3": unknown option "retries"`,
+	}, {
+		name:     "url invalid timeout",
+		in:       "tcp://10.1.1.1:8080?dialTimeout=soon~80",
+		parseErr: `forward source: invalid endpoint "tcp://10.1.1.1:8080\?dialTimeout=soon": invalid dialTimeout: .*`,
+	}, {
+		name:     "url timeouts on both endpoints",
+		in:       "tcp://10.1.1.1:8080?dialTimeout=5s~onion://:80?idleTimeout=1m",
+		parseErr: `invalid forward ".*": timeouts may be given on the source or the destination, not both`,
+	}, {
+		name:     "url unix socket without destination",
+		in:       "unix://" + socketPath,
+		parseErr: `invalid forward ".*": a destination must be given, as in unix://.*~DEST`,
+	}, {
+		name:     "url import without destination",
+		in:       "onion://xxx.onion:80",
+		parseErr: `invalid forward "onion://xxx.onion:80": a destination must be given, as in onion://xxx.onion:80~DEST`,
+	}, {
+		name:     "url auth on export",
+		in:       "tcp://10.1.1.1:8080?auth=me~80",
+		parseErr: `forward source: client authorization only applies to imported onions`,
 	}, {
 		name:     "chaining",
 		in:       "80~81~82",
@@ -189,3 +485,138 @@ func TestForward(t *testing.T) {
 		})
 	}
 }
+
+func TestForwardDescription(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		in, desc string
+	}{{
+		in:   "127.0.0.1:8000~80,8080",
+		desc: "127.0.0.1:8000 => abc.onion:80,8080",
+	}, {
+		in:   "[::1]:8000~80",
+		desc: "[::1]:8000 => abc.onion:80",
+	}, {
+		in:   "127.0.0.1:9000-9002~80,8000-8001",
+		desc: "127.0.0.1:9000-9002 => abc.onion:80,8000-8001",
+	}, {
+		in:   "127.0.0.1:8443=443,8080=80",
+		desc: "127.0.0.1:8443,8080 => abc.onion:443,80",
+	}, {
+		in:   "xxx.onion:80~[::1]:8080",
+		desc: "xxx.onion:80 => [::1]:8080",
+	}}
+	for _, test := range tests {
+		fwd, err := ParseForward(test.in)
+		c.Assert(err, qt.IsNil)
+		c.Check(fwd.Description(map[string]string{"": "abc"}), qt.Equals, test.desc)
+	}
+}
+
+func TestForwardString(t *testing.T) {
+	c := qt.New(t)
+	socketPath := filepath.Join(c.Mkdir(), "server.sock")
+	ln, err := net.Listen("unix", socketPath)
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { ln.Close() })
+
+	tests := []struct {
+		in, canonical string
+	}{{
+		in:        "8080",
+		canonical: "127.0.0.1:8080~8080",
+	}, {
+		in:        "localhost:8000~80,8080,8081@web",
+		canonical: "localhost:8000~80,8080-8081@web",
+	}, {
+		in:        socketPath + "~80",
+		canonical: socketPath + "~80",
+	}, {
+		in:        "[0::1]:8000~80",
+		canonical: "[::1]:8000~80",
+	}, {
+		in:        "9000-9002",
+		canonical: "127.0.0.1:9000-9002=9000-9002",
+	}, {
+		in:        "127.0.0.1:9000-9002~80,443,8000",
+		canonical: "127.0.0.1:9000=80,9001=443,9002=8000",
+	}, {
+		in:        "[::1]:8443=443,8080=80,9000-9001=10000-10001@svc",
+		canonical: "[::1]:8443=443,8080=80,9000-9001=10000-10001@svc",
+	}, {
+		in:        "8080=80",
+		canonical: "127.0.0.1:8080~80",
+	}, {
+		in:        "xxx.onion:80~" + socketPath,
+		canonical: "xxx.onion:80~" + socketPath,
+	}, {
+		in:        "xxx.onion:80~[::1]:8080",
+		canonical: "xxx.onion:80~[::1]:8080",
+	}, {
+		in:        "tcp://[::1]:8000",
+		canonical: "[::1]:8000~8000",
+	}, {
+		in:        "onion://xxx.onion?auth=me~8080",
+		canonical: "onion://xxx.onion:80?auth=me~127.0.0.1:8080",
+	}}
+	for i, test := range tests {
+		c.Run(fmt.Sprintf("%d %s", i, test.in), func(c *qt.C) {
+			fwd, err := ParseForward(test.in)
+			c.Assert(err, qt.IsNil)
+			c.Assert(fwd.String(), qt.Equals, test.canonical)
+
+			reparsed, err := ParseForward(fwd.String())
+			c.Assert(err, qt.IsNil)
+			c.Assert(reparsed, qt.CmpEquals(cmp.AllowUnexported(Forward{}, Endpoint{})), fwd)
+			c.Assert(reparsed.String(), qt.Equals, test.canonical)
+
+			fromDoc, err := fwd.Doc().Forward()
+			c.Assert(err, qt.IsNil)
+			c.Assert(fromDoc, qt.CmpEquals(cmp.AllowUnexported(Forward{}, Endpoint{})), fwd)
+		})
+	}
+}
+
+func TestForwardPrivateKeyAuth(t *testing.T) {
+	c := qt.New(t)
+	key := strings.Repeat("a", 52)
+	fwd, err := ParseForward("onion://xxx.onion:80?auth=" + key + "~8080")
+	c.Assert(err, qt.IsNil)
+	c.Assert(fwd.Source().Auth(), qt.Equals, key)
+	c.Assert(fwd.String(), qt.Equals, "xxx.onion:80~127.0.0.1:8080")
+	c.Assert(fwd.Doc().Src.Auth, qt.Equals, "")
+}
+
+func TestLookupContacts(t *testing.T) {
+	c := qt.New(t)
+	onionID := strings.Repeat("a", 56)
+	lookup := LookupContacts(func(name string) (string, string, bool) {
+		if name == "bob-wiki" {
+			return onionID, "me", true
+		}
+		return "", "", false
+	})
+	for in, auth := range map[string]string{
+		"onion://bob-wiki:80~8080":                  "me",
+		"onion://bob-wiki:80?auth=work~tcp://:8080": "work",
+	} {
+		fwd, err := ParseForward(in, lookup)
+		c.Assert(err, qt.IsNil, qt.Commentf("%s", in))
+		c.Assert(fwd.Source().Auth(), qt.Equals, auth)
+		c.Assert(fwd.String(), qt.Equals, "onion://"+onionID+".onion:80?auth="+auth+"~127.0.0.1:8080")
+	}
+	fwd, err := ParseForward("localhost:8000~80", lookup)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fwd.IsImport(), qt.IsFalse)
+
+	// A local host with a contact's name is still exported.
+	lookupLocalhost := LookupContacts(func(name string) (string, string, bool) {
+		return onionID, "", name == "localhost"
+	})
+	fwd, err = ParseForward("localhost:5432~5432", lookupLocalhost)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fwd.IsImport(), qt.IsFalse)
+	c.Assert(fwd.String(), qt.Equals, "localhost:5432~5432")
+	_, err = ParseForward("onion://alice:80~8080", lookup)
+	c.Assert(err, qt.ErrorMatches, `forward source: onion endpoint must be an onion address to import, or the ports of an export`)
+}
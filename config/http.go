@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// ForwardType is the protocol relayed by a forward.
+type ForwardType string
+
+const (
+	// TCPForward relays TCP connections as-is.
+	TCPForward ForwardType = "tcp"
+	// HTTPForward serves exported connections with a reverse HTTP proxy in
+	// front of the backends.
+	HTTPForward ForwardType = "http"
+)
+
+// ParseForwardType returns a ForwardType from its string representation. An
+// empty string is the default, TCPForward.
+func ParseForwardType(s string) (ForwardType, error) {
+	switch t := ForwardType(s); t {
+	case "":
+		return TCPForward, nil
+	case TCPForward, HTTPForward:
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid forward type %q", s)
+	}
+}
+
+// HTTPProxy configures the reverse proxy of an http export.
+type HTTPProxy struct {
+	// Host is the Host header sent to backends. If empty, it is the address
+	// of the route's backend, or the export's first backend.
+	Host string
+	// Headers are set on requests sent to backends.
+	Headers map[string]string
+	// ResponseHeaders are set on responses sent to clients.
+	ResponseHeaders map[string]string
+	// Routes send requests for matching paths to other backends, rather than
+	// the export's source or backends.
+	Routes []Route
+}
+
+// Route sends requests for paths under a prefix to a backend.
+type Route struct {
+	// Path is the path prefix of requests matching the route. A prefix
+	// ending in "/" matches any path under it, otherwise the path must match
+	// exactly.
+	Path    string
+	Backend *Endpoint
+}
+
+// Match returns whether the route matches a request path.
+func (r Route) Match(path string) bool {
+	if strings.HasSuffix(r.Path, "/") {
+		return strings.HasPrefix(path, r.Path)
+	}
+	return path == r.Path
+}
+
+// HTTPProxyDoc defines a JSON representation of an http export's reverse
+// proxy.
+type HTTPProxyDoc struct {
+	Host            string            `json:"host,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+	Routes          []RouteDoc        `json:"routes,omitempty"`
+}
+
+// RouteDoc defines a JSON representation of a route.
+type RouteDoc struct {
+	Path    string      `json:"path"`
+	Backend EndpointDoc `json:"backend"`
+}
+
+// HTTPProxy returns a validated HTTPProxy from a JSON document object model.
+// Routes are ordered with the longest path first, so that the first matching
+// route is the most specific one.
+func (d *HTTPProxyDoc) HTTPProxy() (HTTPProxy, error) {
+	h := HTTPProxy{Host: d.Host}
+	var err error
+	if h.Headers, err = parseHeaders("headers", d.Headers); err != nil {
+		return HTTPProxy{}, err
+	}
+	if h.ResponseHeaders, err = parseHeaders("responseHeaders", d.ResponseHeaders); err != nil {
+		return HTTPProxy{}, err
+	}
+	for i := range d.Routes {
+		rd := &d.Routes[i]
+		if !strings.HasPrefix(rd.Path, "/") {
+			return HTTPProxy{}, fmt.Errorf("route %d: path %q must start with \"/\"", i, rd.Path)
+		}
+		if IsOnionHost(rd.Backend.Host) {
+			return HTTPProxy{}, fmt.Errorf("route %d: backends must be local", i)
+		}
+		backend, err := rd.Backend.Endpoint(false, false)
+		if err != nil {
+			return HTTPProxy{}, fmt.Errorf("route %d: %w", i, err)
+		}
+		if _, err := backend.SingleAddr(); err != nil {
+			return HTTPProxy{}, fmt.Errorf("route %d: %w", i, err)
+		}
+		h.Routes = append(h.Routes, Route{Path: rd.Path, Backend: backend})
+	}
+	sort.SliceStable(h.Routes, func(i, j int) bool {
+		return len(h.Routes[i].Path) > len(h.Routes[j].Path)
+	})
+	return h, nil
+}
+
+// IsZero returns whether no reverse proxy options are set.
+func (h HTTPProxy) IsZero() bool {
+	return h.Host == "" && len(h.Headers) == 0 && len(h.ResponseHeaders) == 0 && len(h.Routes) == 0
+}
+
+// Doc returns a JSON document object model of the reverse proxy.
+func (h HTTPProxy) Doc() *HTTPProxyDoc {
+	d := &HTTPProxyDoc{
+		Host:            h.Host,
+		Headers:         h.Headers,
+		ResponseHeaders: h.ResponseHeaders,
+	}
+	for _, route := range h.Routes {
+		d.Routes = append(d.Routes, RouteDoc{Path: route.Path, Backend: route.Backend.Doc()})
+	}
+	return d
+}
+
+// parseHeaders returns headers with canonical names, checking that they are
+// valid.
+func parseHeaders(name string, in map[string]string) (map[string]string, error) {
+	if len(in) == 0 {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for k, v := range in {
+		if k == "" || strings.ContainsAny(k, " \t:\r\n") {
+			return nil, fmt.Errorf("invalid %s name %q", name, k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("invalid %s value for %q", name, k)
+		}
+		out[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return out, nil
+}
+
+// OnionLocation configures a reverse HTTP proxy in front of a clearnet site
+// served by the same backend as an export, which adds Onion-Location headers
+// pointing at the export's onion address.
+type OnionLocation struct {
+	// Listen is the local address the proxy listens on, for clearnet
+	// clients.
+	Listen *Endpoint
+	// Backend is the clearnet site's backend. If nil, it is the export's
+	// source.
+	Backend *Endpoint
+}
+
+// IsZero returns whether the Onion-Location proxy is not configured.
+func (o OnionLocation) IsZero() bool {
+	return o.Listen == nil
+}
+
+// OnionLocationDoc defines a JSON representation of an Onion-Location
+// proxy.
+type OnionLocationDoc struct {
+	Listen  EndpointDoc  `json:"listen"`
+	Backend *EndpointDoc `json:"backend,omitempty"`
+}
+
+// OnionLocation returns a validated OnionLocation from a JSON document object
+// model.
+func (d *OnionLocationDoc) OnionLocation() (OnionLocation, error) {
+	if IsOnionHost(d.Listen.Host) || d.Listen.Path != "" {
+		return OnionLocation{}, fmt.Errorf("listen address must be a local TCP address")
+	}
+	listen, err := d.Listen.Endpoint(false, false)
+	if err != nil {
+		return OnionLocation{}, fmt.Errorf("listen: %w", err)
+	}
+	if _, err := listen.SingleAddr(); err != nil {
+		return OnionLocation{}, fmt.Errorf("listen: %w", err)
+	}
+	o := OnionLocation{Listen: listen}
+	if d.Backend != nil {
+		if IsOnionHost(d.Backend.Host) {
+			return OnionLocation{}, fmt.Errorf("backend must be local")
+		}
+		o.Backend, err = d.Backend.Endpoint(false, false)
+		if err != nil {
+			return OnionLocation{}, fmt.Errorf("backend: %w", err)
+		}
+		if _, err := o.Backend.SingleAddr(); err != nil {
+			return OnionLocation{}, fmt.Errorf("backend: %w", err)
+		}
+	}
+	return o, nil
+}
+
+// Doc returns a JSON document object model of the Onion-Location proxy.
+func (o OnionLocation) Doc() *OnionLocationDoc {
+	d := &OnionLocationDoc{Listen: o.Listen.Doc()}
+	if o.Backend != nil {
+		backend := o.Backend.Doc()
+		d.Backend = &backend
+	}
+	return d
+}
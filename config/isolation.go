@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// Isolation defines which connections relayed through an import forward may
+// share Tor circuits. Connections are isolated from each other with distinct
+// SOCKS credentials, which Tor isolates onto separate circuits.
+type Isolation string
+
+const (
+	// NoIsolation lets connections share circuits with any other
+	// connections which are not isolated.
+	NoIsolation Isolation = "none"
+	// IsolateDestination isolates connections to different onions and ports
+	// from each other.
+	IsolateDestination Isolation = "destination"
+	// IsolateClient isolates connections from different local client
+	// addresses from each other, and from other destinations.
+	IsolateClient Isolation = "client"
+	// IsolateConnection isolates every connection from all others.
+	IsolateConnection Isolation = "connection"
+)
+
+// ParseIsolation returns an Isolation from its string representation. An
+// empty string is the default, NoIsolation.
+func ParseIsolation(s string) (Isolation, error) {
+	switch i := Isolation(s); i {
+	case "":
+		return NoIsolation, nil
+	case NoIsolation, IsolateDestination, IsolateClient, IsolateConnection:
+		return i, nil
+	default:
+		return "", fmt.Errorf("invalid isolation %q", s)
+	}
+}
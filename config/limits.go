@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits defines connection limits applied to a forward. A zero value for any
+// limit means that limit is not enforced.
+type Limits struct {
+	// MaxConns is the maximum number of concurrent connections relayed
+	// through the forward. Connections accepted beyond this limit are
+	// rejected.
+	MaxConns int
+	// IdleTimeout closes a relayed connection once no data has been
+	// transferred in either direction for this long.
+	IdleTimeout time.Duration
+	// MaxLifetime closes a relayed connection once it has been open for this
+	// long, regardless of activity.
+	MaxLifetime time.Duration
+	// DialTimeout limits how long to wait on connecting to the forward's
+	// source before giving up on a relayed connection.
+	DialTimeout time.Duration
+	// Rate limits the bytes per second transferred in each direction,
+	// shared among all connections relayed through the forward.
+	Rate int64
+	// ConnRate limits the bytes per second transferred in each direction,
+	// for each connection relayed through the forward.
+	ConnRate int64
+}
+
+// IsZero returns whether no limits are set.
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// LimitsDoc defines a JSON representation of forward limits. Durations are
+// strings in the format accepted by time.ParseDuration, such as "30s" or
+// "5m". Rates are strings in the format accepted by ParseBytes, such as
+// "512K" or "1M".
+type LimitsDoc struct {
+	MaxConns    int    `json:"maxConns,omitempty"`
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+	MaxLifetime string `json:"maxLifetime,omitempty"`
+	DialTimeout string `json:"dialTimeout,omitempty"`
+	Rate        string `json:"rate,omitempty"`
+	ConnRate    string `json:"connRate,omitempty"`
+}
+
+// Limits returns validated Limits from a JSON document object model.
+func (d *LimitsDoc) Limits() (Limits, error) {
+	if d.MaxConns < 0 {
+		return Limits{}, fmt.Errorf("invalid maxConns %d", d.MaxConns)
+	}
+	l := Limits{MaxConns: d.MaxConns}
+	var err error
+	if l.IdleTimeout, err = parseDuration("idleTimeout", d.IdleTimeout); err != nil {
+		return Limits{}, err
+	}
+	if l.MaxLifetime, err = parseDuration("maxLifetime", d.MaxLifetime); err != nil {
+		return Limits{}, err
+	}
+	if l.DialTimeout, err = parseDuration("dialTimeout", d.DialTimeout); err != nil {
+		return Limits{}, err
+	}
+	if l.Rate, err = parseRate("rate", d.Rate); err != nil {
+		return Limits{}, err
+	}
+	if l.ConnRate, err = parseRate("connRate", d.ConnRate); err != nil {
+		return Limits{}, err
+	}
+	return l, nil
+}
+
+// Doc returns a JSON document object model of the limits.
+func (l Limits) Doc() *LimitsDoc {
+	return &LimitsDoc{
+		MaxConns:    l.MaxConns,
+		IdleTimeout: formatDuration(l.IdleTimeout),
+		MaxLifetime: formatDuration(l.MaxLifetime),
+		DialTimeout: formatDuration(l.DialTimeout),
+		Rate:        formatRate(l.Rate),
+		ConnRate:    formatRate(l.ConnRate),
+	}
+}
+
+// Merge returns the limits, with those which are set in o replacing them.
+func (l Limits) Merge(o Limits) Limits {
+	if o.MaxConns != 0 {
+		l.MaxConns = o.MaxConns
+	}
+	if o.IdleTimeout != 0 {
+		l.IdleTimeout = o.IdleTimeout
+	}
+	if o.MaxLifetime != 0 {
+		l.MaxLifetime = o.MaxLifetime
+	}
+	if o.DialTimeout != 0 {
+		l.DialTimeout = o.DialTimeout
+	}
+	if o.Rate != 0 {
+		l.Rate = o.Rate
+	}
+	if o.ConnRate != 0 {
+		l.ConnRate = o.ConnRate
+	}
+	return l
+}
+
+// parseDuration parses a non-negative duration, where an empty string is a
+// zero duration.
+func parseDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s: must not be negative", name)
+	}
+	return d, nil
+}
+
+// formatDuration formats a duration for parseDuration, where a zero duration
+// is an empty string.
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func formatRate(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return FormatBytes(n)
+}
+
+func parseRate(name, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// ParseBytes parses a non-negative number of bytes, optionally suffixed with
+// a K, M or G binary multiplier. For example, "512K" is 524288 bytes.
+func ParseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("missing value")
+	}
+	num, mult := s, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number of bytes %q", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("too large")
+	}
+	return n * mult, nil
+}
+
+// FormatBytes formats a number of bytes for ParseBytes, with the largest
+// binary multiplier which represents it exactly.
+func FormatBytes(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		mult   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n != 0 && n%unit.mult == 0 {
+			return strconv.FormatInt(n/unit.mult, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseBytes(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		in  string
+		n   int64
+		err string
+	}{
+		{in: "0", n: 0},
+		{in: "1000", n: 1000},
+		{in: "512K", n: 512 << 10},
+		{in: "512k", n: 512 << 10},
+		{in: "2M", n: 2 << 20},
+		{in: "1G", n: 1 << 30},
+		{in: "", err: "missing value"},
+		{in: "K", err: `invalid number of bytes "K"`},
+		{in: "1.5M", err: `invalid number of bytes "1.5M"`},
+		{in: "-1", err: "must not be negative"},
+		{in: "9223372036854775807G", err: "too large"},
+	}
+	for i, test := range tests {
+		c.Run(fmt.Sprintf("%d %s", i, test.in), func(c *qt.C) {
+			n, err := ParseBytes(test.in)
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(n, qt.Equals, test.n)
+		})
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	c := qt.New(t)
+	for n, s := range map[int64]string{
+		0:             "0",
+		1000:          "1000",
+		1536:          "1536",
+		512 << 10:     "512K",
+		2 << 20:       "2M",
+		1 << 30:       "1G",
+		3<<30 + 1<<20: "3073M",
+	} {
+		c.Check(FormatBytes(n), qt.Equals, s)
+		parsed, err := ParseBytes(s)
+		c.Assert(err, qt.IsNil)
+		c.Check(parsed, qt.Equals, n)
+	}
+}
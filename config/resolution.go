@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Resolution defines when the host name of a local source endpoint is
+// resolved to an address. By default, host names are resolved once, when the
+// endpoint is resolved, and the address is used for as long as onionpipe
+// runs. Backends which may change address, such as containers which are
+// restarted, can instead be resolved lazily, as they are connected to.
+type Resolution struct {
+	// Lazy keeps the endpoint's host name, which is resolved when connecting
+	// to it. Failing to resolve the host name when the endpoint is resolved
+	// is only a warning, so that backends may start later.
+	Lazy bool
+	// TTL is how long a lazily resolved address is used for, before the
+	// host name is resolved again. If zero, the host name is resolved for
+	// each connection.
+	TTL time.Duration
+}
+
+// Resolution values as represented in forward documents and flags.
+const (
+	resolveOnce = "once"
+	resolveDial = "dial"
+)
+
+// ParseResolution returns a Resolution from its string representation:
+// "once" (or empty) resolves once, "dial" lazily resolves for each
+// connection, and a duration such as "30s" lazily resolves with that TTL.
+func ParseResolution(s string) (Resolution, error) {
+	switch s {
+	case "", resolveOnce:
+		return Resolution{}, nil
+	case resolveDial:
+		return Resolution{Lazy: true}, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return Resolution{}, fmt.Errorf("invalid resolution %q: must be %q, %q or a positive duration", s, resolveOnce, resolveDial)
+	}
+	return Resolution{Lazy: true, TTL: ttl}, nil
+}
+
+// String returns the string representation of the resolution, which is empty
+// for the default.
+func (r Resolution) String() string {
+	switch {
+	case !r.Lazy:
+		return ""
+	case r.TTL == 0:
+		return resolveDial
+	default:
+		return r.TTL.String()
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default backoff between retries of a failed dial.
+const (
+	DefaultInitialBackoff = time.Second
+	DefaultMaxBackoff     = 30 * time.Second
+)
+
+// Retry defines how failed dials to an import forward's onion are retried.
+// A zero Deadline disables retries.
+type Retry struct {
+	// Deadline is how long to keep retrying a failed dial, holding the local
+	// connection open in the meantime.
+	Deadline time.Duration
+	// InitialBackoff is how long to wait before the first retry. The backoff
+	// doubles after each failed retry.
+	InitialBackoff time.Duration
+	// MaxBackoff is the most to wait between retries.
+	MaxBackoff time.Duration
+}
+
+// RetryDoc defines a JSON representation of dial retries. Durations are
+// strings in the format accepted by time.ParseDuration.
+type RetryDoc struct {
+	Deadline       string `json:"deadline,omitempty"`
+	InitialBackoff string `json:"initialBackoff,omitempty"`
+	MaxBackoff     string `json:"maxBackoff,omitempty"`
+}
+
+// NewRetry returns a Retry with the given deadline and default backoff.
+func NewRetry(deadline time.Duration) Retry {
+	if deadline == 0 {
+		return Retry{}
+	}
+	return Retry{
+		Deadline:       deadline,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+	}
+}
+
+// Retry returns a validated Retry from a JSON document object model. Unset
+// backoffs are given default values.
+func (d *RetryDoc) Retry() (Retry, error) {
+	deadline, err := parseDuration("deadline", d.Deadline)
+	if err != nil {
+		return Retry{}, err
+	}
+	r := NewRetry(deadline)
+	if d.InitialBackoff != "" {
+		if r.InitialBackoff, err = parseDuration("initialBackoff", d.InitialBackoff); err != nil {
+			return Retry{}, err
+		}
+	}
+	if d.MaxBackoff != "" {
+		if r.MaxBackoff, err = parseDuration("maxBackoff", d.MaxBackoff); err != nil {
+			return Retry{}, err
+		}
+	}
+	if r.Deadline > 0 && r.InitialBackoff <= 0 {
+		return Retry{}, fmt.Errorf("initialBackoff must be positive")
+	}
+	if r.InitialBackoff > r.MaxBackoff {
+		return Retry{}, fmt.Errorf("initialBackoff must not exceed maxBackoff")
+	}
+	return r, nil
+}
+
+// Doc returns a JSON document object model of the retries.
+func (r Retry) Doc() *RetryDoc {
+	return &RetryDoc{
+		Deadline:       formatDuration(r.Deadline),
+		InitialBackoff: formatDuration(r.InitialBackoff),
+		MaxBackoff:     formatDuration(r.MaxBackoff),
+	}
+}
+
+// Backoff returns how long to wait before the given retry, numbered from 1.
+func (r Retry) Backoff(retry int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < retry && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	return backoff
+}
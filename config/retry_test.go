@@ -0,0 +1,44 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRetry(t *testing.T) {
+	c := qt.New(t)
+
+	r, err := (&RetryDoc{Deadline: "1m"}).Retry()
+	c.Assert(err, qt.IsNil)
+	c.Assert(r, qt.Equals, Retry{
+		Deadline:       time.Minute,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+	})
+	var backoffs []time.Duration
+	for i := 1; i <= 7; i++ {
+		backoffs = append(backoffs, r.Backoff(i))
+	}
+	c.Assert(backoffs, qt.DeepEquals, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 30 * time.Second, 30 * time.Second,
+	})
+
+	r, err = (&RetryDoc{Deadline: "10s", InitialBackoff: "100ms", MaxBackoff: "1s"}).Retry()
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Backoff(1), qt.Equals, 100*time.Millisecond)
+	c.Assert(r.Backoff(5), qt.Equals, time.Second)
+
+	r, err = (&RetryDoc{}).Retry()
+	c.Assert(err, qt.IsNil)
+	c.Assert(r, qt.Equals, Retry{})
+
+	_, err = (&RetryDoc{Deadline: "10s", InitialBackoff: "1m"}).Retry()
+	c.Assert(err, qt.ErrorMatches, "initialBackoff must not exceed maxBackoff")
+	_, err = (&RetryDoc{Deadline: "10s", InitialBackoff: "0s"}).Retry()
+	c.Assert(err, qt.ErrorMatches, "initialBackoff must be positive")
+	_, err = (&RetryDoc{Deadline: "-10s"}).Retry()
+	c.Assert(err, qt.ErrorMatches, "invalid deadline: must not be negative")
+}
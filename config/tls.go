@@ -0,0 +1,101 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// LocalTLS configures TLS termination on the local destination of an import
+// forward, for clients which insist on TLS.
+type LocalTLS struct {
+	// CertFile and KeyFile are PEM files with the certificate and private
+	// key to serve. If empty, a self-signed certificate is generated for the
+	// destination host.
+	CertFile string
+	KeyFile  string
+}
+
+// SelfSigned returns whether a self-signed certificate is to be generated.
+func (t *LocalTLS) SelfSigned() bool {
+	return t.CertFile == ""
+}
+
+// LocalTLSDoc defines a JSON representation of local TLS termination.
+type LocalTLSDoc struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// LocalTLS returns a validated LocalTLS from a JSON document object model.
+func (d *LocalTLSDoc) LocalTLS() (*LocalTLS, error) {
+	return NewLocalTLS(d.CertFile, d.KeyFile)
+}
+
+// Doc returns a JSON document object model of the local TLS termination.
+func (t *LocalTLS) Doc() *LocalTLSDoc {
+	return &LocalTLSDoc{CertFile: t.CertFile, KeyFile: t.KeyFile}
+}
+
+// NewLocalTLS returns a new LocalTLS serving the given certificate and key,
+// or a self-signed certificate if neither are given.
+func NewLocalTLS(certFile, keyFile string) (*LocalTLS, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("certFile and keyFile must be given together")
+	}
+	return &LocalTLS{CertFile: certFile, KeyFile: keyFile}, nil
+}
+
+// RemoteTLS configures TLS origination from an import forward to its onion,
+// for onion services which speak TLS. The onion's certificate must match a
+// pinned fingerprint, or be verified by a CA bundle, or both.
+type RemoteTLS struct {
+	// ServerName is the name verified in the onion's certificate, and sent
+	// with SNI. If empty, it is the onion host name.
+	ServerName string
+	// Fingerprint is the SHA-256 digest of the onion's leaf certificate.
+	Fingerprint []byte
+	// CAFile is a PEM bundle of CA certificates which verify the onion's
+	// certificate.
+	CAFile string
+}
+
+// RemoteTLSDoc defines a JSON representation of remote TLS origination.
+type RemoteTLSDoc struct {
+	ServerName  string `json:"serverName,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	CAFile      string `json:"caFile,omitempty"`
+}
+
+// RemoteTLS returns a validated RemoteTLS from a JSON document object model.
+func (d *RemoteTLSDoc) RemoteTLS() (*RemoteTLS, error) {
+	return NewRemoteTLS(d.ServerName, d.Fingerprint, d.CAFile)
+}
+
+// Doc returns a JSON document object model of the remote TLS origination.
+func (t *RemoteTLS) Doc() *RemoteTLSDoc {
+	return &RemoteTLSDoc{
+		ServerName:  t.ServerName,
+		Fingerprint: hex.EncodeToString(t.Fingerprint),
+		CAFile:      t.CAFile,
+	}
+}
+
+// NewRemoteTLS returns a new RemoteTLS verifying the onion's certificate
+// with a fingerprint, given in hex optionally separated by colons, or a CA
+// bundle.
+func NewRemoteTLS(serverName, fingerprint, caFile string) (*RemoteTLS, error) {
+	if fingerprint == "" && caFile == "" {
+		return nil, fmt.Errorf("fingerprint or caFile is required to verify the onion")
+	}
+	t := &RemoteTLS{ServerName: serverName, CAFile: caFile}
+	if fingerprint != "" {
+		fp, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+		if err != nil || len(fp) != sha256.Size {
+			return nil, fmt.Errorf("invalid fingerprint %q: must be a hex SHA-256 digest", fingerprint)
+		}
+		t.Fingerprint = fp
+	}
+	return t, nil
+}
@@ -0,0 +1,184 @@
+package forwarding
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// accessRecord records a connection relayed through a forward.
+type accessRecord struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Forward string    `json:"forward"`
+	Stream  uint32    `json:"stream"`
+	// Peer is the local end of the forward: the client of an import, or the
+	// backend of an export.
+	Peer string `json:"peer,omitempty"`
+	// BytesIn is the number of bytes received from the connecting side, and
+	// BytesOut the number of bytes sent to it.
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// Duration is in seconds.
+	Duration float64 `json:"duration"`
+	Reason   string  `json:"reason"`
+}
+
+// Close reasons recorded in the access log.
+const (
+	reasonClosed      = "closed"
+	reasonIdle        = "idle timeout"
+	reasonLifetime    = "max lifetime"
+	reasonRejected    = "rejected: connection limit"
+	reasonDialFailed  = "dial failed"
+	reasonCopyFailure = "error"
+)
+
+// accessLogger writes access records to a writer shared by the forwards
+// logging to the same place.
+type accessLogger struct {
+	format config.AccessLogFormat
+	out    *accessWriter
+}
+
+func (l *accessLogger) log(rec *accessRecord) {
+	rec.Duration = rec.End.Sub(rec.Start).Seconds()
+	var line []byte
+	switch l.format {
+	case config.CommonLog:
+		peer := rec.Peer
+		if peer == "" {
+			peer = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] %q %d %d %d %.3f %q\n",
+			peer, rec.Start.Format("02/Jan/2006:15:04:05 -0700"), rec.Forward,
+			rec.Stream, rec.BytesIn, rec.BytesOut, rec.Duration, rec.Reason))
+	default:
+		var err error
+		line, err = json.Marshal(rec)
+		if err != nil {
+			log.Printf("access log: %v", err)
+			return
+		}
+		line = append(line, '\n')
+	}
+	l.out.write(line)
+}
+
+// accessWriter serializes writes of whole records.
+type accessWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+
+	// maxSize and maxBackups are how the file written to is rotated.
+	maxSize    int64
+	maxBackups int
+}
+
+func (w *accessWriter) write(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if _, err := w.w.Write(line); err != nil {
+		log.Printf("access log: %v", err)
+	}
+}
+
+// close closes the log file, if any. Records written afterwards are dropped.
+func (w *accessWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if f, ok := w.w.(*rotatingFile); ok && !w.closed {
+		if err := f.Close(); err != nil {
+			log.Printf("access log: %v", err)
+		}
+	}
+	w.closed = true
+}
+
+// rotatingFile is a log file which is rotated once it reaches a maximum
+// size. Rotated files are renamed with a numeric suffix, the most recent
+// being ".1", keeping at most maxBackups of them.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+// Write implements io.Writer. Callers must serialize writes. If the file
+// cannot be rotated, the record is still appended to it, and rotation is
+// retried by the next write.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	var rotateErr error
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			rotateErr = fmt.Errorf("failed to rotate %s: %w", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, errors.Join(rotateErr, err)
+}
+
+// rotate renames the log file to make way for a new one. The log file is
+// reopened even if it could not be renamed, so that logging continues.
+func (r *rotatingFile) rotate() error {
+	closeErr := r.f.Close()
+	err := r.shift()
+	if openErr := r.open(); openErr != nil {
+		return errors.Join(closeErr, err, openErr)
+	}
+	return errors.Join(closeErr, err)
+}
+
+// shift renames the closed log file and its backups, removing the oldest.
+func (r *rotatingFile) shift() error {
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxBackups > 0 {
+		return os.Rename(r.path, r.path+".1")
+	}
+	return os.Remove(r.path)
+}
+
+// Close implements io.Closer.
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
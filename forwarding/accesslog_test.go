@@ -0,0 +1,194 @@
+package forwarding
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func (b *syncBuffer) records(c *qt.C) []accessRecord {
+	var recs []accessRecord
+	for _, line := range b.lines() {
+		if line == "" {
+			continue
+		}
+		var rec accessRecord
+		c.Assert(json.Unmarshal([]byte(line), &rec), qt.IsNil)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func startLoggedRelay(c *qt.C, format config.AccessLogFormat, limits config.Limits, dial dialFunc) (*syncBuffer, string) {
+	var buf syncBuffer
+	r := newRelay("test", limits, dial)
+	r.access = &accessLogger{format: format, out: &accessWriter{w: &buf}}
+	return &buf, serveRelay(c, r)
+}
+
+func TestAccessLog(t *testing.T) {
+	c := qt.New(t)
+	echoAddr := startEcho(c)
+
+	c.Run("json", func(c *qt.C) {
+		buf, addr := startLoggedRelay(c, config.JSONLog, config.Limits{}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		assertEcho(c, conn, "hello")
+		conn.Close()
+		c.Assert(waitFor(func() bool { return len(buf.records(c)) == 1 }), qt.IsTrue)
+		rec := buf.records(c)[0]
+		c.Assert(rec.Forward, qt.Equals, "test")
+		c.Assert(rec.Peer, qt.Equals, conn.LocalAddr().String())
+		c.Assert(rec.BytesIn, qt.Equals, int64(5))
+		c.Assert(rec.BytesOut, qt.Equals, int64(5))
+		c.Assert(rec.Reason, qt.Equals, reasonClosed)
+		c.Assert(rec.Stream, qt.Not(qt.Equals), uint32(0))
+		c.Assert(rec.End.Before(rec.Start), qt.IsFalse)
+	})
+
+	c.Run("idle timeout", func(c *qt.C) {
+		buf, addr := startLoggedRelay(c, config.JSONLog, config.Limits{IdleTimeout: 100 * time.Millisecond}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertClosed(c, conn, 5*time.Second)
+		c.Assert(waitFor(func() bool { return len(buf.records(c)) == 1 }), qt.IsTrue)
+		c.Assert(buf.records(c)[0].Reason, qt.Equals, reasonIdle)
+	})
+
+	c.Run("dial failed", func(c *qt.C) {
+		buf, addr := startLoggedRelay(c, config.JSONLog, config.Limits{}, func(context.Context) (net.Conn, error) {
+			return nil, errors.New("no route")
+		})
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertClosed(c, conn, 5*time.Second)
+		c.Assert(waitFor(func() bool { return len(buf.records(c)) == 1 }), qt.IsTrue)
+		c.Assert(buf.records(c)[0].Reason, qt.Equals, "dial failed: no route")
+	})
+
+	c.Run("common", func(c *qt.C) {
+		buf, addr := startLoggedRelay(c, config.CommonLog, config.Limits{}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		assertEcho(c, conn, "hi")
+		conn.Close()
+		c.Assert(waitFor(func() bool { return buf.lines()[0] != "" }), qt.IsTrue)
+		c.Assert(buf.lines()[0], qt.Matches,
+			regexp.QuoteMeta(conn.LocalAddr().String())+` - - \[.*\] "test" \d+ 2 2 \d+\.\d{3} "closed"`)
+	})
+}
+
+func TestSharedAccessLog(t *testing.T) {
+	c := qt.New(t)
+	s := New(nil)
+	c.Cleanup(s.closeAccessLogs)
+	path := filepath.Join(c.Mkdir(), "access.log")
+	rotated := config.AccessLog{Format: config.JSONLog, File: path, MaxSize: 1024, MaxBackups: 5}
+
+	a, err := s.accessLogger(rotated)
+	c.Assert(err, qt.IsNil)
+	b, err := s.accessLogger(rotated)
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.out, qt.Equals, a.out)
+
+	// Other formats may share the file, as long as it is rotated the same
+	// way.
+	common := rotated
+	common.Format = config.CommonLog
+	_, err = s.accessLogger(common)
+	c.Assert(err, qt.IsNil)
+
+	for _, al := range []config.AccessLog{
+		{Format: config.JSONLog, File: path},
+		{Format: config.JSONLog, File: path, MaxSize: 2048, MaxBackups: 5},
+		{Format: config.JSONLog, File: path, MaxSize: 1024, MaxBackups: 1},
+	} {
+		_, err := s.accessLogger(al)
+		c.Assert(err, qt.ErrorMatches, `access log ".*" is rotated differently by another forward`)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		c.Assert(err, qt.IsNil)
+	}
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(name)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(got), qt.Equals, want)
+	}
+	_, err = os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestRotatingFileRenameFails(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.Mkdir(), "access.log")
+	// A non-empty directory in the way of the backup cannot be replaced.
+	c.Assert(os.MkdirAll(filepath.Join(path+".1", "busy"), 0700), qt.IsNil)
+	f, err := openRotatingFile(path, 10, 1)
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	_, err = f.Write([]byte("first\n"))
+	c.Assert(err, qt.IsNil)
+	for _, line := range []string{"second\n", "third\n"} {
+		n, err := f.Write([]byte(line))
+		c.Assert(err, qt.ErrorMatches, "failed to rotate .*")
+		c.Assert(n, qt.Equals, len(line))
+	}
+	got, err := os.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(got), qt.Equals, "first\nsecond\nthird\n")
+
+	// Rotation resumes once the way is clear.
+	c.Assert(os.RemoveAll(path+".1"), qt.IsNil)
+	_, err = f.Write([]byte("fourth\n"))
+	c.Assert(err, qt.IsNil)
+	got, err = os.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(got), qt.Equals, "fourth\n")
+}
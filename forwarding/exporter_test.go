@@ -0,0 +1,65 @@
+package forwarding
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+func TestExportTargets(t *testing.T) {
+	c := qt.New(t)
+	tests := []struct {
+		name    string
+		in      string
+		limits  config.Limits
+		targets map[string][]int
+		err     string
+	}{{
+		name:    "single port",
+		in:      "127.0.0.1:8000~80,8080",
+		targets: map[string][]int{"127.0.0.1:8000": {80, 8080}},
+	}, {
+		name: "port range",
+		in:   "127.0.0.1:9000-9002~10000-10002@svc",
+		targets: map[string][]int{
+			"127.0.0.1:9000": {10000},
+			"127.0.0.1:9001": {10001},
+			"127.0.0.1:9002": {10002},
+		},
+	}, {
+		name: "port range mapped to list",
+		in:   "[::1]:9000-9001~80,443",
+		targets: map[string][]int{
+			"[::1]:9000": {80},
+			"[::1]:9001": {443},
+		},
+	}, {
+		name: "port map",
+		in:   "192.168.1.100:8443=443,8080=80",
+		targets: map[string][]int{
+			"192.168.1.100:8443": {443},
+			"192.168.1.100:8080": {80},
+		},
+	}, {
+		name:   "relayed port range",
+		in:     "127.0.0.1:9000-9002~9000-9002",
+		limits: config.Limits{MaxConns: 1},
+		err:    `127.0.0.1:9000-9002 => .onion:9000-9002: several source ports cannot be relayed; .*`,
+	}}
+	for _, test := range tests {
+		c.Run(test.name, func(c *qt.C) {
+			fwd, err := config.ParseForward(test.in)
+			c.Assert(err, qt.IsNil)
+			fwd.SetLimits(test.limits)
+			targets, err := exportTargets(fwd)
+			if test.err != "" {
+				c.Assert(err, qt.ErrorMatches, test.err)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(targets, qt.DeepEquals, test.targets)
+		})
+	}
+}
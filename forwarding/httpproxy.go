@@ -0,0 +1,251 @@
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// httpProxy is a reverse HTTP proxy in front of an http export's backends.
+// Connections relayed to it are served in-process, and its requests are sent
+// to the export's pool of backends, or to the backend of a matching route.
+type httpProxy struct {
+	desc      string
+	conf      config.HTTPProxy
+	pool      *pool
+	routes    []*backend
+	onionHost string
+
+	srv   *http.Server
+	conns *connListener
+}
+
+// URL hosts of proxied requests, which tell dialTarget where to connect.
+// Transport keeps separate idle connections for each.
+const (
+	// defaultTarget is the export's pool, which may be connected to any of
+	// its backends.
+	defaultTarget = "pool"
+	// backendTarget is followed by the index of one of the pool's backends.
+	backendTarget = "backend"
+	// routeTarget is followed by the index of a route.
+	routeTarget = "route"
+)
+
+// ReadHeaderTimeout is how long HTTP servers in front of forwards wait for a
+// client to send request headers, so that slow clients cannot tie up
+// connections.
+const ReadHeaderTimeout = 30 * time.Second
+
+// IdleTimeout is how long HTTP servers in front of forwards keep an idle
+// keep-alive connection open for a client's next request.
+const IdleTimeout = 2 * time.Minute
+
+func newHTTPProxy(desc string, conf config.HTTPProxy, p *pool) *httpProxy {
+	h := &httpProxy{
+		desc:      desc,
+		conf:      conf,
+		pool:      p,
+		onionHost: p.onionHost,
+		conns:     newConnListener(),
+	}
+	for _, route := range conf.Routes {
+		h.routes = append(h.routes, newBackend(route.Backend))
+	}
+	transport := &http.Transport{
+		DialContext: h.dialTarget,
+	}
+	h.srv = &http.Server{
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		IdleTimeout:       IdleTimeout,
+		Handler: &httputil.ReverseProxy{
+			Rewrite:        h.rewrite,
+			Transport:      transport,
+			ModifyResponse: h.modifyResponse,
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.Printf("%s: %s %s: %v", h.desc, req.Method, req.URL.Path, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if sc, ok := conn.(*streamConn); ok {
+				return withStream(ctx, sc.st)
+			}
+			return ctx
+		},
+	}
+	return h
+}
+
+// serve serves relayed connections until the context is done.
+func (h *httpProxy) serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		h.srv.Close()
+	}()
+	if err := h.srv.Serve(h.conns); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("%s: http proxy: %v", h.desc, err)
+	}
+}
+
+// dial returns a connection to the proxy, for a relay to connect a stream
+// to.
+func (h *httpProxy) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	st, _ := streamFrom(ctx)
+	if err := h.conns.push(ctx, &streamConn{Conn: server, st: st}); err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// rewrite rewrites a request from an onion client into a request to a
+// backend. Hop-by-hop headers are removed by the ReverseProxy.
+func (h *httpProxy) rewrite(pr *httputil.ProxyRequest) {
+	target, b := defaultTarget, (*backend)(nil)
+	for i, route := range h.conf.Routes {
+		if route.Match(pr.In.URL.Path) {
+			target, b = routeTarget+strconv.Itoa(i), h.routes[i]
+			break
+		}
+	}
+	if b == nil && h.conf.Host == "" {
+		// The Host header names the backend, so the backend is chosen now
+		// rather than when a connection is dialed.
+		i := h.pool.pick()
+		target, b = backendTarget+strconv.Itoa(i), h.pool.backends[i]
+	}
+	pr.SetURL(&url.URL{Scheme: "http", Host: target})
+	pr.Out.Host = h.conf.Host
+	if pr.Out.Host == "" {
+		pr.Out.Host = b.hostHeader()
+	}
+
+	// Onion clients are anonymous; the stream's synthetic source address
+	// identifies the connection, as in a PROXY protocol header.
+	st, _ := streamFrom(pr.In.Context())
+	pr.Out.Header.Set("X-Forwarded-For", streamSource(st.id).String())
+	host := pr.In.Host
+	if !strings.HasSuffix(hostOnly(host), ".onion") {
+		host = h.onionHost
+	}
+	pr.Out.Header.Set("X-Forwarded-Host", host)
+	pr.Out.Header.Set("X-Forwarded-Proto", "http")
+	for k, v := range h.conf.Headers {
+		pr.Out.Header.Set(k, v)
+	}
+}
+
+func (h *httpProxy) modifyResponse(resp *http.Response) error {
+	for k, v := range h.conf.ResponseHeaders {
+		resp.Header.Set(k, v)
+	}
+	return nil
+}
+
+// dialTarget connects to the backend of a request's target.
+func (h *httpProxy) dialTarget(ctx context.Context, _, addr string) (net.Conn, error) {
+	target := hostOnly(addr)
+	if target == defaultTarget {
+		return h.pool.dial(ctx)
+	}
+	if i, ok := targetIndex(target, backendTarget, len(h.pool.backends)); ok {
+		return h.pool.dialBackend(ctx, i)
+	}
+	if i, ok := targetIndex(target, routeTarget, len(h.routes)); ok {
+		return h.routes[i].dial(ctx)
+	}
+	return nil, fmt.Errorf("unknown target %q", addr)
+}
+
+// targetIndex returns the index in a target URL host with the given prefix,
+// if it is less than n.
+func targetIndex(target, prefix string, n int) (int, bool) {
+	s, ok := strings.CutPrefix(target, prefix)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= n {
+		return 0, false
+	}
+	return i, true
+}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// streamConn is a connection served by the proxy, with the stream relayed
+// to it.
+type streamConn struct {
+	net.Conn
+	st stream
+}
+
+// connListener is a net.Listener which accepts connections pushed to it.
+type connListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(ctx context.Context, conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return net.ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Accept implements net.Listener.
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements net.Listener.
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (l *connListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,171 @@
+package forwarding
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// echoRequest is what an echoing backend received.
+type echoRequest struct {
+	Name   string
+	Host   string
+	Path   string
+	Header http.Header
+}
+
+// startHTTPEcho starts an HTTP server which responds with the request it
+// received, returning its address.
+func startHTTPEcho(c *qt.C, name string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(echoRequest{Name: name, Host: req.Host, Path: req.URL.Path, Header: req.Header})
+	}))
+	c.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestHTTPProxy(t *testing.T) {
+	c := qt.New(t)
+	app := startHTTPEcho(c, "app")
+	api := startHTTPEcho(c, "api")
+
+	fwd, err := (&config.ForwardDoc{
+		Src:  endpointDoc(c, app),
+		Dest: config.EndpointDoc{Ports: []int{80}},
+		Type: "http",
+		HTTP: &config.HTTPProxyDoc{
+			Headers:         map[string]string{"X-Served-By": "onionpipe"},
+			ResponseHeaders: map[string]string{"Onion-Location-Test": "yes"},
+			Routes: []config.RouteDoc{{
+				Path:    "/api/",
+				Backend: endpointDoc(c, api),
+			}},
+		},
+	}).Forward()
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	p := newPool("test", fwd)
+	p.onionHost = "abc.onion"
+	h := newHTTPProxy("test", fwd.HTTPProxy(), p)
+	go h.serve(ctx)
+	r := newRelay("test", config.Limits{}, h.dial)
+	addr := serveRelay(c, r)
+
+	get := func(c *qt.C, path, host string) (echoRequest, http.Header) {
+		req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+		c.Assert(err, qt.IsNil)
+		req.Host = host
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "secret")
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, qt.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+		var echo echoRequest
+		c.Assert(json.NewDecoder(resp.Body).Decode(&echo), qt.IsNil)
+		return echo, resp.Header
+	}
+
+	c.Run("default backend", func(c *qt.C) {
+		echo, respHeader := get(c, "/index.html", "abc.onion")
+		c.Assert(echo.Name, qt.Equals, "app")
+		c.Assert(echo.Host, qt.Equals, app)
+		c.Assert(echo.Path, qt.Equals, "/index.html")
+		c.Assert(echo.Header.Get("X-Forwarded-Host"), qt.Equals, "abc.onion")
+		c.Assert(echo.Header.Get("X-Forwarded-Proto"), qt.Equals, "http")
+		c.Assert(strings.HasPrefix(echo.Header.Get("X-Forwarded-For"), "fc00:dead:beef:4dad::"), qt.IsTrue)
+		c.Assert(echo.Header.Get("X-Served-By"), qt.Equals, "onionpipe")
+		c.Assert(echo.Header.Get("X-Hop"), qt.Equals, "")
+		c.Assert(respHeader.Get("Onion-Location-Test"), qt.Equals, "yes")
+	})
+
+	c.Run("route", func(c *qt.C) {
+		echo, _ := get(c, "/api/v1/users", "abc.onion")
+		c.Assert(echo.Name, qt.Equals, "api")
+		c.Assert(echo.Host, qt.Equals, api)
+		c.Assert(echo.Path, qt.Equals, "/api/v1/users")
+	})
+
+	c.Run("non-onion host", func(c *qt.C) {
+		echo, _ := get(c, "/", "localhost:8080")
+		c.Assert(echo.Header.Get("X-Forwarded-Host"), qt.Equals, "abc.onion")
+	})
+}
+
+func TestHTTPProxyBalance(t *testing.T) {
+	c := qt.New(t)
+	backends := map[string]string{
+		"a": startHTTPEcho(c, "a"),
+		"b": startHTTPEcho(c, "b"),
+	}
+	fwd, err := (&config.ForwardDoc{
+		Backends: []config.EndpointDoc{endpointDoc(c, backends["a"]), endpointDoc(c, backends["b"])},
+		Dest:     config.EndpointDoc{Ports: []int{80}},
+		Type:     "http",
+	}).Forward()
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	h := newHTTPProxy("test", fwd.HTTPProxy(), newPool("test", fwd))
+	go h.serve(ctx)
+	addr := serveRelay(c, newRelay("test", config.Limits{}, h.dial))
+
+	// Requests are balanced among the backends, and each is sent with the
+	// Host of the backend which received it, even over kept-alive
+	// connections.
+	client := &http.Client{Transport: &http.Transport{}}
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get("http://" + addr + "/")
+		c.Assert(err, qt.IsNil)
+		var echo echoRequest
+		c.Assert(json.NewDecoder(resp.Body).Decode(&echo), qt.IsNil)
+		resp.Body.Close()
+		c.Assert(echo.Host, qt.Equals, backends[echo.Name])
+		seen[echo.Name] = true
+	}
+	c.Assert(seen, qt.DeepEquals, map[string]bool{"a": true, "b": true})
+}
+
+func TestOnionLocation(t *testing.T) {
+	c := qt.New(t)
+	site := startHTTPEcho(c, "site")
+	fwd, err := (&config.ForwardDoc{
+		Src:  endpointDoc(c, site),
+		Dest: config.EndpointDoc{Ports: []int{80}},
+	}).Forward()
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	go newOnionLocation("test", newBackend(fwd.Source()), onionURL("abc", 80)).serve(ctx, l)
+
+	req, err := http.NewRequest("GET", "http://"+l.Addr().String()+"/blog/post?id=1", nil)
+	c.Assert(err, qt.IsNil)
+	req.Host = "example.com"
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("Onion-Location"), qt.Equals, "http://abc.onion/blog/post?id=1")
+	var echo echoRequest
+	c.Assert(json.NewDecoder(resp.Body).Decode(&echo), qt.IsNil)
+	c.Assert(echo.Name, qt.Equals, "site")
+	c.Assert(echo.Host, qt.Equals, "example.com")
+	c.Assert(echo.Header.Get("X-Forwarded-For"), qt.Equals, "127.0.0.1")
+
+	c.Assert(onionURL("abc", 8080), qt.Equals, "http://abc.onion:8080")
+}
@@ -0,0 +1,56 @@
+package forwarding
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cretz/bine/tor"
+	"golang.org/x/net/proxy"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// isolationAuth returns the SOCKS credentials which isolate a stream to an
+// imported onion address onto its own circuits, according to the isolation
+// policy. Tor isolates streams with different SOCKS credentials from each
+// other. Nil is returned when the stream need not be isolated.
+func isolationAuth(policy config.Isolation, onionAddr string, st stream) *proxy.Auth {
+	var key string
+	switch policy {
+	case config.IsolateDestination:
+		key = onionAddr
+	case config.IsolateClient:
+		key = onionAddr + " " + clientHost(st.client)
+	case config.IsolateConnection:
+		key = fmt.Sprintf("%s #%d", onionAddr, st.id)
+	default:
+		return nil
+	}
+	return &proxy.Auth{User: "onionpipe-" + string(policy), Password: key}
+}
+
+// clientHost returns the host of a client address, so that connections from
+// the same client on different ports share an isolation key.
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// socksProxyAddr looks up the network and address of Tor's SOCKS listener,
+// so that isolated dialers need not each look it up again.
+func socksProxyAddr(t *tor.Tor) (network, addr string, err error) {
+	info, err := t.Control.GetInfo("net/listeners/socks")
+	if err != nil {
+		return "", "", err
+	}
+	if len(info) != 1 || info[0].Key != "net/listeners/socks" {
+		return "", "", fmt.Errorf("unable to get socks proxy address")
+	}
+	if path, ok := strings.CutPrefix(info[0].Val, "unix:"); ok {
+		return "unix", path, nil
+	}
+	return "tcp", info[0].Val, nil
+}
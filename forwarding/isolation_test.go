@@ -0,0 +1,52 @@
+package forwarding
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"golang.org/x/net/proxy"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+func TestIsolationAuth(t *testing.T) {
+	c := qt.New(t)
+	st1 := stream{id: 1, client: "127.0.0.1:40001"}
+	st2 := stream{id: 2, client: "127.0.0.1:40002"}
+	st3 := stream{id: 3, client: "192.168.1.2:40001"}
+
+	tests := []struct {
+		policy config.Isolation
+		// same lists whether each of st2 and st3 shares circuits with st1.
+		same [2]bool
+	}{
+		{config.NoIsolation, [2]bool{true, true}},
+		{config.IsolateDestination, [2]bool{true, true}},
+		{config.IsolateClient, [2]bool{true, false}},
+		{config.IsolateConnection, [2]bool{false, false}},
+	}
+	for _, test := range tests {
+		c.Run(string(test.policy), func(c *qt.C) {
+			auth1 := isolationAuth(test.policy, "xxx.onion:80", st1)
+			for i, st := range []stream{st2, st3} {
+				auth := isolationAuth(test.policy, "xxx.onion:80", st)
+				c.Check(sameAuth(auth1, auth), qt.Equals, test.same[i], qt.Commentf("stream %d", st.id))
+			}
+			if test.policy != config.NoIsolation {
+				other := isolationAuth(test.policy, "yyy.onion:80", st1)
+				c.Check(sameAuth(auth1, other), qt.IsFalse)
+			}
+		})
+	}
+
+	c.Run("none", func(c *qt.C) {
+		c.Assert(isolationAuth(config.NoIsolation, "xxx.onion:80", st1), qt.IsNil)
+	})
+}
+
+func sameAuth(a, b *proxy.Auth) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
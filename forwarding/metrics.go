@@ -0,0 +1,243 @@
+package forwarding
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// processStart is when the process started, for reporting uptime.
+var processStart = time.Now()
+
+// descriptorStats counts the onion service descriptor uploads reported by
+// Tor, per onion ID.
+type descriptorStats struct {
+	mu      sync.Mutex
+	uploads map[string]*descriptorUploads
+}
+
+// descriptorUploads counts the descriptor uploads of an onion service, which
+// Tor attempts to several directories each time it is published.
+type descriptorUploads struct {
+	attempted, uploaded, failed uint64
+}
+
+func newDescriptorStats() *descriptorStats {
+	return &descriptorStats{uploads: map[string]*descriptorUploads{}}
+}
+
+func (d *descriptorStats) record(ev *control.HSDescEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.uploads[ev.Address]
+	if !ok {
+		u = &descriptorUploads{}
+		d.uploads[ev.Address] = u
+	}
+	switch ev.Action {
+	case "UPLOAD":
+		u.attempted++
+	case "UPLOADED":
+		u.uploaded++
+	case "FAILED":
+		u.failed++
+	}
+}
+
+func (d *descriptorStats) get(onionID string) descriptorUploads {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if u, ok := d.uploads[onionID]; ok {
+		return *u
+	}
+	return descriptorUploads{}
+}
+
+// watchDescriptors records descriptor upload events from Tor until the
+// context is done.
+func (s *Service) watchDescriptors(ctx context.Context) error {
+	events := make(chan control.Event, 16)
+	if err := s.tor.Control.AddEventListener(events, control.EventCodeHSDesc); err != nil {
+		return fmt.Errorf("failed to watch descriptor uploads: %w", err)
+	}
+	go func() {
+		if err := s.tor.Control.HandleEvents(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("failed to handle tor events: %v", err)
+		}
+	}()
+	go func() {
+		// Keep receiving while the listener is removed, so that events
+		// relayed meanwhile do not block the control connection.
+		done, removed := ctx.Done(), make(chan struct{})
+		for {
+			select {
+			case ev := <-events:
+				if hs, ok := ev.(*control.HSDescEvent); ok {
+					s.descriptors.record(hs)
+				}
+			case <-done:
+				done = nil
+				go func() {
+					s.tor.Control.RemoveEventListener(events, control.EventCodeHSDesc)
+					close(removed)
+				}()
+			case <-removed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// torBootstrapProgress returns Tor's bootstrap progress, as a percentage.
+func (s *Service) torBootstrapProgress() (int, error) {
+	info, err := s.tor.Control.GetInfo("status/bootstrap-phase")
+	if err != nil {
+		return 0, err
+	}
+	for _, kv := range info {
+		for _, field := range strings.Fields(kv.Val) {
+			if v, ok := strings.CutPrefix(field, "PROGRESS="); ok {
+				return strconv.Atoi(v)
+			}
+		}
+	}
+	return 0, fmt.Errorf("bootstrap progress not found")
+}
+
+// WriteMetrics writes the service's metrics in the Prometheus text
+// exposition format. Connection metrics are labeled by forward description,
+// and only reported for relayed forwards. Onion service metrics are labeled
+// by alias.
+func (s *Service) WriteMetrics(w io.Writer) error {
+	mw := &metricWriter{w: bufio.NewWriter(w)}
+
+	mw.header("onionpipe_uptime_seconds", "gauge", "Seconds since onionpipe started.")
+	mw.sample("onionpipe_uptime_seconds", nil, time.Since(processStart).Seconds())
+
+	if s.tor != nil && s.tor.Control != nil {
+		progress, err := s.torBootstrapProgress()
+		if err != nil {
+			log.Printf("failed to get tor bootstrap progress: %v", err)
+		} else {
+			mw.header("onionpipe_tor_bootstrap_progress", "gauge", "Tor bootstrap progress, as a percentage.")
+			mw.sample("onionpipe_tor_bootstrap_progress", nil, float64(progress))
+		}
+	}
+
+	var relayed []ForwardStatus
+	for _, st := range s.Status() {
+		if st.Relayed {
+			relayed = append(relayed, st)
+		}
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		value           func(st ForwardStatus) float64
+	}{{
+		"onionpipe_connections_active", "gauge", "Connections currently relayed.",
+		func(st ForwardStatus) float64 { return float64(st.ActiveConns) },
+	}, {
+		"onionpipe_connections_total", "counter", "Connections relayed.",
+		func(st ForwardStatus) float64 { return float64(st.TotalConns) },
+	}, {
+		"onionpipe_connections_rejected_total", "counter", "Connections rejected due to the connection limit.",
+		func(st ForwardStatus) float64 { return float64(st.Rejected) },
+	}, {
+		"onionpipe_dial_failures_total", "counter", "Failed attempts to connect to the far side of forwards.",
+		func(st ForwardStatus) float64 { return float64(st.DialFailures) },
+	}} {
+		mw.header(m.name, m.typ, m.help)
+		for _, st := range relayed {
+			mw.sample(m.name, []string{"forward", st.Forward}, m.value(st))
+		}
+	}
+	mw.header("onionpipe_bytes_total", "counter", "Bytes relayed, received from (in) and sent to (out) clients.")
+	for _, st := range relayed {
+		mw.sample("onionpipe_bytes_total", []string{"forward", st.Forward, "direction", "in"}, float64(st.BytesIn))
+		mw.sample("onionpipe_bytes_total", []string{"forward", st.Forward, "direction", "out"}, float64(st.BytesOut))
+	}
+
+	aliases := make([]string, 0, len(s.onions))
+	for alias := range s.onions {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	mw.header("onionpipe_onion_published", "gauge", "Whether the onion service is published.")
+	for _, alias := range aliases {
+		o := s.onions[alias]
+		var published float64
+		if o.published() {
+			published = 1
+		}
+		mw.sample("onionpipe_onion_published", []string{"alias", alias, "onion", o.id}, published)
+	}
+	if s.metrics {
+		mw.header("onionpipe_descriptor_uploads_total", "counter", "Onion service descriptor uploads to directories, by result.")
+		for _, alias := range aliases {
+			o := s.onions[alias]
+			u := s.descriptors.get(o.id)
+			for _, result := range []struct {
+				name  string
+				count uint64
+			}{{"attempted", u.attempted}, {"uploaded", u.uploaded}, {"failed", u.failed}} {
+				mw.sample("onionpipe_descriptor_uploads_total",
+					[]string{"alias", alias, "onion", o.id, "result", result.name}, float64(result.count))
+			}
+		}
+	}
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// metricWriter writes metrics in the Prometheus text exposition format,
+// keeping the first error.
+type metricWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (mw *metricWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the named metric, with labels given as
+// alternating names and values.
+func (mw *metricWriter) sample(name string, labels []string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			sb.WriteByte('{')
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	if len(labels) > 0 {
+		sb.WriteByte('}')
+	}
+	mw.printf("%s %s\n", sb.String(), strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,137 @@
+package forwarding
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := qt.New(t)
+	fwd, err := config.ParseForward("127.0.0.1:8080~80@web")
+	c.Assert(err, qt.IsNil)
+	direct, err := config.ParseForward("127.0.0.1:8081~81")
+	c.Assert(err, qt.IsNil)
+	s := New(nil, fwd, direct)
+	CollectMetrics(s)
+
+	// Relay one echoed connection, and fail to dial another.
+	addr := startEcho(c)
+	var fail atomic.Bool
+	r := newRelay(`test "web"`, fwd.Limits(), func(ctx context.Context) (net.Conn, error) {
+		if fail.Load() {
+			return nil, errors.New("refused")
+		}
+		return dialTCP(addr)(ctx)
+	})
+	s.relays[fwd] = r
+	relayAddr := serveRelay(c, r)
+	conn, err := net.Dial("tcp", relayAddr)
+	c.Assert(err, qt.IsNil)
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	for r.active.Load() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fail.Store(true)
+	conn, err = net.Dial("tcp", relayAddr)
+	c.Assert(err, qt.IsNil)
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	s.onions = map[string]*onion{"web": {alias: "web", id: "abc", fwd: nil}}
+	for _, action := range []string{"UPLOAD", "UPLOAD", "UPLOADED", "FAILED"} {
+		s.descriptors.record(&control.HSDescEvent{Action: action, Address: "abc"})
+	}
+	s.descriptors.record(&control.HSDescEvent{Action: "UPLOAD", Address: "other"})
+
+	var buf bytes.Buffer
+	c.Assert(s.WriteMetrics(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Matches, `(?s)# HELP onionpipe_uptime_seconds .*
+# TYPE onionpipe_uptime_seconds gauge
+onionpipe_uptime_seconds [0-9.]+
+.*`)
+	c.Assert(buf.String(), qt.Contains, `# TYPE onionpipe_connections_active gauge
+onionpipe_connections_active{forward="test \"web\""} 0
+# HELP onionpipe_connections_total Connections relayed.
+# TYPE onionpipe_connections_total counter
+onionpipe_connections_total{forward="test \"web\""} 2
+`)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_dial_failures_total{forward="test \"web\""} 1
+`)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_bytes_total{forward="test \"web\"",direction="in"} 5
+onionpipe_bytes_total{forward="test \"web\"",direction="out"} 5
+`)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_onion_published{alias="web",onion="abc"} 0
+`)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_descriptor_uploads_total{alias="web",onion="abc",result="attempted"} 2
+onionpipe_descriptor_uploads_total{alias="web",onion="abc",result="uploaded"} 1
+onionpipe_descriptor_uploads_total{alias="web",onion="abc",result="failed"} 1
+`)
+	// Forwards which are not relayed have no connection metrics.
+	c.Assert(buf.String(), qt.Not(qt.Contains), direct.Description(nil))
+}
+
+func TestMetricsRelayPlainExport(t *testing.T) {
+	c := qt.New(t)
+	addr := startEcho(c)
+	plain, err := config.ParseForward(addr + "~80")
+	c.Assert(err, qt.IsNil)
+	ports, err := config.ParseForward("127.0.0.1:8000-8001~8000-8001")
+	c.Assert(err, qt.IsNil)
+	s := New(nil, plain, ports)
+	c.Cleanup(s.removeRunDir)
+
+	// Without metrics, Tor connects to plain exports directly.
+	c.Assert(s.relayed(plain), qt.IsFalse)
+	CollectMetrics(s)
+	c.Assert(s.relayed(plain), qt.IsTrue)
+	c.Assert(s.relayed(ports), qt.IsFalse)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	ls, targets, err := s.listenRelays(plain)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ls, qt.HasLen, 1)
+	c.Assert(targets, qt.DeepEquals, map[string][]int{"unix:" + ls[0].Addr().String(): {80}})
+	s.startRelay(ctx, plain, "plain", nil, ls, nil)
+
+	conn, err := net.Dial("unix", ls[0].Addr().String())
+	c.Assert(err, qt.IsNil)
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	r := s.relays[plain]
+	for r.active.Load() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	c.Assert(s.WriteMetrics(&buf), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_connections_total{forward="plain"} 1
+`)
+	c.Assert(buf.String(), qt.Contains, `
+onionpipe_bytes_total{forward="plain",direction="in"} 5
+onionpipe_bytes_total{forward="plain",direction="out"} 5
+`)
+}
@@ -0,0 +1,116 @@
+package forwarding
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/cretz/bine/tor"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// onion is an onion service published for the exports sharing an alias. It
+// may be unpublished while exports with the Unpublish health policy are
+// unavailable, and published again with the same key once they recover.
+type onion struct {
+	alias string
+	tor   *tor.Tor
+	conf  *tor.ForwardConf
+
+	mu     sync.Mutex
+	fwd    *tor.OnionForward
+	id     string
+	down   map[*config.Forward]bool
+	closed bool
+}
+
+func newOnion(t *tor.Tor, alias string, conf *tor.ForwardConf) *onion {
+	return &onion{
+		alias: alias,
+		tor:   t,
+		conf:  conf,
+		down:  map[*config.Forward]bool{},
+	}
+}
+
+// publish adds the onion service to Tor, waiting until it is published.
+func (o *onion) publish(ctx context.Context) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.fwd != nil || len(o.down) > 0 {
+		return nil
+	}
+	fwd, err := o.tor.Forward(ctx, o.conf)
+	if err != nil {
+		return fmt.Errorf("Failed to create onion forward: %v", err)
+	}
+	o.fwd = fwd
+	if o.id == "" {
+		// Keep the key, so that the onion address is the same if it is
+		// published again.
+		o.id = fwd.ID
+		o.conf.Key = fwd.Key
+	}
+	return nil
+}
+
+// unpublish removes the onion service from Tor.
+func (o *onion) unpublish() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.fwd == nil {
+		return
+	}
+	if err := o.fwd.Close(); err != nil {
+		log.Printf("failed to unpublish %s.onion: %v", o.id, err)
+	}
+	o.fwd = nil
+}
+
+// published returns whether the onion service is currently published.
+func (o *onion) published() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.fwd != nil
+}
+
+// close unpublishes the onion service, so that it will not be published
+// again.
+func (o *onion) close() {
+	o.unpublish()
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+}
+
+// setAvailable updates whether an export with the Unpublish health policy is
+// available. The onion is unpublished while any such export is unavailable,
+// and published again once they all recover.
+func (o *onion) setAvailable(ctx context.Context, export *config.Forward, available bool) {
+	o.mu.Lock()
+	if available {
+		delete(o.down, export)
+	} else {
+		o.down[export] = true
+	}
+	down := len(o.down)
+	o.mu.Unlock()
+
+	if down > 0 {
+		log.Printf("unpublishing %s.onion while %d export(s) are unavailable", o.id, down)
+		o.unpublish()
+		return
+	}
+	go func() {
+		publishCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+		defer cancel()
+		log.Printf("publishing %s.onion", o.id)
+		if err := o.publish(publishCtx); err != nil {
+			log.Printf("failed to publish %s.onion: %v", o.id, err)
+			return
+		}
+		log.Printf("published %s.onion", o.id)
+	}()
+}
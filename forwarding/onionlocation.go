@@ -0,0 +1,81 @@
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// onionLocation is a reverse HTTP proxy in front of a clearnet site, which
+// adds an Onion-Location header to responses, so that Tor Browser offers
+// users the same page at the export's onion address.
+type onionLocation struct {
+	desc     string
+	backend  *backend
+	onionURL string
+	srv      *http.Server
+}
+
+func newOnionLocation(desc string, b *backend, onionURL string) *onionLocation {
+	o := &onionLocation{
+		desc:     desc,
+		backend:  b,
+		onionURL: onionURL,
+	}
+	o.srv = &http.Server{
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		IdleTimeout:       IdleTimeout,
+		Handler: &httputil.ReverseProxy{
+			Rewrite: o.rewrite,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return b.dial(ctx)
+				},
+			},
+			ModifyResponse: o.modifyResponse,
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.Printf("%s: onion location: %s %s: %v", o.desc, req.Method, req.URL.Path, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+	}
+	return o
+}
+
+// onionURL returns the base URL of an onion port.
+func onionURL(onionID string, port int) string {
+	if port == 80 {
+		return fmt.Sprintf("http://%s.onion", onionID)
+	}
+	return fmt.Sprintf("http://%s.onion:%d", onionID, port)
+}
+
+// serve serves clearnet clients on the listener until the context is done.
+func (o *onionLocation) serve(ctx context.Context, l net.Listener) {
+	go func() {
+		<-ctx.Done()
+		o.srv.Close()
+	}()
+	if err := o.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("%s: onion location: %v", o.desc, err)
+	}
+}
+
+// rewrite passes a clearnet request through to the backend as-is, apart from
+// the usual forwarding headers. The clearnet Host is kept, since the backend
+// serves the clearnet site.
+func (o *onionLocation) rewrite(pr *httputil.ProxyRequest) {
+	pr.SetURL(&url.URL{Scheme: "http", Host: defaultTarget})
+	pr.Out.Host = pr.In.Host
+	pr.SetXForwarded()
+}
+
+func (o *onionLocation) modifyResponse(resp *http.Response) error {
+	resp.Header.Set("Onion-Location", o.onionURL+resp.Request.URL.RequestURI())
+	return nil
+}
@@ -0,0 +1,366 @@
+package forwarding
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// backend is a local endpoint that an export connects to.
+type backend struct {
+	addr    string
+	network string
+
+	// lookup resolves the address to dial, if the backend's host name is
+	// resolved lazily. Resolved addresses are kept for ttl, if set. mu
+	// guards resolved and expires.
+	lookup   func(ctx context.Context) (string, error)
+	ttl      time.Duration
+	mu       sync.Mutex
+	resolved string
+	expires  time.Time
+
+	active  atomic.Int64
+	healthy atomic.Bool
+}
+
+func newBackend(endp *config.Endpoint) *backend {
+	b := &backend{network: "tcp"}
+	if endp.IsUnix() {
+		b.network = "unix"
+	}
+	b.addr, _ = endp.SingleAddr()
+	if res := endp.Resolution(); res.Lazy {
+		b.lookup, b.ttl = endp.LookupAddr, res.TTL
+	}
+	b.healthy.Store(true)
+	return b
+}
+
+// dialAddr returns the address to dial, resolving the backend's host name if
+// it is resolved lazily and the last resolved address has expired.
+func (b *backend) dialAddr(ctx context.Context) (string, error) {
+	if b.lookup == nil {
+		return b.addr, nil
+	}
+	b.mu.Lock()
+	resolved, expires := b.resolved, b.expires
+	b.mu.Unlock()
+	if resolved != "" && time.Now().Before(expires) {
+		return resolved, nil
+	}
+	// Look up without holding the lock, so that a slow resolver does not
+	// hold up dials which could use a cached address. Concurrent dials may
+	// each look up an expired address.
+	addr, err := b.lookup(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve local address %q: %w", b.addr, err)
+	}
+	if b.ttl > 0 {
+		b.mu.Lock()
+		b.resolved, b.expires = addr, time.Now().Add(b.ttl)
+		b.mu.Unlock()
+	}
+	return addr, nil
+}
+
+// dialContext connects to the backend's current address.
+func (b *backend) dialContext(ctx context.Context) (net.Conn, error) {
+	addr, err := b.dialAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, b.network, addr)
+}
+
+func (b *backend) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := b.dialContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to local address %q: %w", b.addr, err)
+	}
+	b.active.Add(1)
+	return &backendConn{Conn: conn, backend: b}, nil
+}
+
+// hostHeader returns the Host header for HTTP requests to the backend.
+func (b *backend) hostHeader() string {
+	if b.network == "unix" {
+		return "localhost"
+	}
+	return b.addr
+}
+
+// backendConn tracks active connections to a backend.
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+// Close implements net.Conn.
+func (c *backendConn) Close() error {
+	c.once.Do(func() { c.backend.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// pool distributes connections among an export's backends.
+type pool struct {
+	desc     string
+	balance  config.Balance
+	health   config.HealthCheck
+	backends []*backend
+	next     atomic.Uint64
+
+	// proxy is the PROXY protocol header version sent to backends, which
+	// identify connections as coming from onionHost.
+	proxy     config.ProxyProtocol
+	onionHost string
+
+	// onAvailable is called when the pool becomes available, with at least
+	// one healthy backend, or unavailable, with none.
+	onAvailable func(available bool)
+
+	mu          sync.Mutex
+	unavailable bool
+}
+
+func newPool(desc string, fwd *config.Forward) *pool {
+	p := &pool{
+		desc:        desc,
+		balance:     fwd.Balance(),
+		health:      fwd.HealthCheck(),
+		proxy:       fwd.ProxyProtocol(),
+		onAvailable: func(bool) {},
+	}
+	for _, endp := range fwd.Backends() {
+		p.backends = append(p.backends, newBackend(endp))
+	}
+	return p
+}
+
+// dial connects to a backend chosen according to the pool's balance. If the
+// chosen backend cannot be connected to, the others are tried in turn.
+func (p *pool) dial(ctx context.Context) (net.Conn, error) {
+	if p.servesUnavailable() {
+		return serveStatic(p.health.Unavailable), nil
+	}
+	var err error
+	for _, b := range p.candidates() {
+		var conn net.Conn
+		conn, err = b.dial(ctx)
+		if err == nil {
+			return p.sendProxyHeader(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// pick returns the index of the backend a connection should be made to,
+// according to the pool's balance.
+func (p *pool) pick() int {
+	b := p.candidates()[0]
+	for i := range p.backends {
+		if p.backends[i] == b {
+			return i
+		}
+	}
+	return 0
+}
+
+// dialBackend connects to the pool's backend at index i, chosen by pick.
+// Unlike dial, no other backend is tried if it cannot be connected to.
+func (p *pool) dialBackend(ctx context.Context, i int) (net.Conn, error) {
+	if p.servesUnavailable() {
+		return serveStatic(p.health.Unavailable), nil
+	}
+	conn, err := p.backends[i].dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.sendProxyHeader(ctx, conn)
+}
+
+// servesUnavailable returns whether connections should be served the
+// unavailable response, rather than connected to a backend.
+func (p *pool) servesUnavailable() bool {
+	return p.health.Policy == config.ServeUnavailable && p.isUnavailable()
+}
+
+// candidates returns the backends in the order they should be tried. Healthy
+// backends are preferred, but unhealthy ones are still tried as a last
+// resort.
+func (p *pool) candidates() []*backend {
+	var healthy, unhealthy []*backend
+	n := len(p.backends)
+	start := 0
+	if p.balance == config.RoundRobin {
+		start = int(p.next.Add(1)-1) % n
+	}
+	for i := 0; i < n; i++ {
+		b := p.backends[(start+i)%n]
+		if b.healthy.Load() {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+	if p.balance == config.LeastConns {
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active.Load() < healthy[j].active.Load()
+		})
+	}
+	return append(healthy, unhealthy...)
+}
+
+// sendProxyHeader sends a PROXY protocol header to a backend connection, if
+// configured.
+func (p *pool) sendProxyHeader(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if p.proxy == config.NoProxyProtocol {
+		return conn, nil
+	}
+	st, _ := streamFrom(ctx)
+	if _, err := conn.Write(proxyHeader(p.proxy, st.id, p.onionHost, st.port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send proxy protocol header: %w", err)
+	}
+	return conn, nil
+}
+
+func (p *pool) isUnavailable() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unavailable
+}
+
+// checkHealth actively checks the health of the pool's backends, until the
+// context is done.
+func (p *pool) checkHealth(ctx context.Context) {
+	if p.health.IsZero() {
+		return
+	}
+	for _, b := range p.backends {
+		go p.checkBackend(ctx, b)
+	}
+}
+
+func (p *pool) checkBackend(ctx context.Context, b *backend) {
+	t := time.NewTicker(p.health.Interval)
+	defer t.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, p.health.Timeout)
+		err := checkHealth(checkCtx, p.health, b)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		healthy := err == nil
+		if b.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Printf("%s: backend %q is healthy", p.desc, b.addr)
+			} else {
+				log.Printf("%s: backend %q is unhealthy: %v", p.desc, b.addr, err)
+			}
+			p.updateAvailable()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// updateAvailable notifies when the pool's availability changes.
+func (p *pool) updateAvailable() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	unavailable := true
+	for _, b := range p.backends {
+		if b.healthy.Load() {
+			unavailable = false
+			break
+		}
+	}
+	if unavailable == p.unavailable {
+		return
+	}
+	p.unavailable = unavailable
+	if unavailable {
+		log.Printf("%s: no healthy backends, export is unavailable (policy %q)", p.desc, p.health.Policy)
+	} else {
+		log.Printf("%s: export is available", p.desc)
+	}
+	p.onAvailable(!unavailable)
+}
+
+// checkHealth checks a backend according to the health check type.
+func checkHealth(ctx context.Context, hc config.HealthCheck, b *backend) error {
+	switch hc.Type {
+	case config.HTTPCheck:
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return b.dialContext(ctx)
+				},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://"+b.hostHeader()+hc.Path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	case config.ExecCheck:
+		cmd := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...)
+		cmd.Env = append(os.Environ(), "ONIONPIPE_BACKEND="+b.addr)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	default:
+		conn, err := b.dialContext(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// serveStatic returns a connection which responds with a static response,
+// then closes.
+func serveStatic(response string) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		go io.Copy(io.Discard, server)
+		server.Write([]byte(response))
+	}()
+	return client
+}
@@ -0,0 +1,216 @@
+package forwarding
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// startNamed starts a local TCP server which writes its name to each
+// connection, returning its address and a function to stop it.
+func startNamed(c *qt.C, name string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func newTestPool(c *qt.C, balance string, addrs ...string) *pool {
+	doc := config.ForwardDoc{Balance: balance}
+	for _, addr := range addrs {
+		doc.Backends = append(doc.Backends, endpointDoc(c, addr))
+	}
+	doc.Dest.Ports = []int{80}
+	fwd, err := doc.Forward()
+	c.Assert(err, qt.IsNil)
+	return newPool("test", fwd)
+}
+
+// endpointDoc returns an endpoint document for a TCP address.
+func endpointDoc(c *qt.C, addr string) config.EndpointDoc {
+	host, port, err := net.SplitHostPort(addr)
+	c.Assert(err, qt.IsNil)
+	var portNum int
+	_, err = fmt.Sscan(port, &portNum)
+	c.Assert(err, qt.IsNil)
+	return config.EndpointDoc{Host: host, Ports: []int{portNum}}
+}
+
+func dialName(c *qt.C, p *pool) (string, net.Conn) {
+	conn, err := p.dial(context.Background())
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	return string(buf), conn
+}
+
+func TestPool(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("round robin", func(c *qt.C) {
+		a, _ := startNamed(c, "a")
+		b, _ := startNamed(c, "b")
+		p := newTestPool(c, "", a, b)
+		var names string
+		for i := 0; i < 4; i++ {
+			name, conn := dialName(c, p)
+			conn.Close()
+			names += name
+		}
+		c.Assert(names, qt.Equals, "abab")
+	})
+
+	c.Run("least conns", func(c *qt.C) {
+		a, _ := startNamed(c, "a")
+		b, _ := startNamed(c, "b")
+		p := newTestPool(c, "least-conns", a, b)
+		name1, conn1 := dialName(c, p)
+		defer conn1.Close()
+		name2, conn2 := dialName(c, p)
+		c.Assert(name1+name2, qt.Equals, "ab")
+		conn2.Close()
+		name3, conn3 := dialName(c, p)
+		defer conn3.Close()
+		c.Assert(name3, qt.Equals, "b")
+	})
+
+	c.Run("failover", func(c *qt.C) {
+		a, stopA := startNamed(c, "a")
+		b, _ := startNamed(c, "b")
+		p := newTestPool(c, "failover", a, b)
+		for i := 0; i < 2; i++ {
+			name, conn := dialName(c, p)
+			conn.Close()
+			c.Assert(name, qt.Equals, "a")
+		}
+		stopA()
+		name, conn := dialName(c, p)
+		conn.Close()
+		c.Assert(name, qt.Equals, "b")
+	})
+
+	c.Run("health check", func(c *qt.C) {
+		a, stopA := startNamed(c, "a")
+		b, _ := startNamed(c, "b")
+		p := newTestPool(c, "failover", a, b)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p.health = config.HealthCheck{Type: config.TCPCheck, Interval: 10 * time.Millisecond, Timeout: time.Second}
+		p.checkHealth(ctx)
+		stopA()
+		c.Assert(waitFor(func() bool { return !p.backends[0].healthy.Load() }), qt.IsTrue)
+		candidates := p.candidates()
+		c.Assert(candidates, qt.HasLen, 2)
+		c.Assert(candidates[0] == p.backends[1], qt.IsTrue)
+		c.Assert(p.backends[1].healthy.Load(), qt.IsTrue)
+	})
+
+	c.Run("unavailable", func(c *qt.C) {
+		a, stopA := startNamed(c, "a")
+		p := newTestPool(c, "", a)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p.health = config.HealthCheck{
+			Type:        config.TCPCheck,
+			Interval:    10 * time.Millisecond,
+			Timeout:     time.Second,
+			Policy:      config.ServeUnavailable,
+			Unavailable: "sorry",
+		}
+		availability := make(chan bool, 1)
+		p.onAvailable = func(available bool) { availability <- available }
+		p.checkHealth(ctx)
+
+		stopA()
+		c.Assert(<-availability, qt.IsFalse)
+		conn, err := p.dial(ctx)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		resp, err := io.ReadAll(conn)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(resp), qt.Equals, "sorry")
+	})
+
+	c.Run("lazy resolution", func(c *qt.C) {
+		a, _ := startNamed(c, "a")
+		b, _ := startNamed(c, "b")
+		for _, test := range []struct {
+			ttl     time.Duration
+			names   string
+			lookups int
+		}{{0, "ab", 2}, {time.Hour, "aa", 1}} {
+			p := newTestPool(c, "", a)
+			// Resolve to a, until it moves to b.
+			addr := a
+			var lookups int
+			p.backends[0].lookup = func(context.Context) (string, error) {
+				lookups++
+				return addr, nil
+			}
+			p.backends[0].ttl = test.ttl
+			name1, conn1 := dialName(c, p)
+			conn1.Close()
+			addr = b
+			name2, conn2 := dialName(c, p)
+			conn2.Close()
+			c.Assert(name1+name2, qt.Equals, test.names, qt.Commentf("ttl %v", test.ttl))
+			c.Assert(lookups, qt.Equals, test.lookups)
+		}
+	})
+}
+
+func TestCheckHealth(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	c.Cleanup(srv.Close)
+	srvURL, err := url.Parse(srv.URL)
+	c.Assert(err, qt.IsNil)
+	b := &backend{network: "tcp", addr: srvURL.Host}
+
+	c.Assert(checkHealth(ctx, config.HealthCheck{Type: config.TCPCheck}, b), qt.IsNil)
+	c.Assert(checkHealth(ctx, config.HealthCheck{Type: config.HTTPCheck, Path: "/healthz"}, b), qt.IsNil)
+	c.Assert(checkHealth(ctx, config.HealthCheck{Type: config.HTTPCheck, Path: "/"}, b),
+		qt.ErrorMatches, "status 404 Not Found")
+	c.Assert(checkHealth(ctx, config.HealthCheck{
+		Type:    config.ExecCheck,
+		Command: []string{"sh", "-c", `test "$ONIONPIPE_BACKEND" = "` + srvURL.Host + `"`},
+	}, b), qt.IsNil)
+	c.Assert(checkHealth(ctx, config.HealthCheck{
+		Type:    config.ExecCheck,
+		Command: []string{"sh", "-c", "echo down; exit 1"},
+	}, b), qt.ErrorMatches, "exit status 1: down")
+
+	srv.Close()
+	c.Assert(checkHealth(ctx, config.HealthCheck{Type: config.TCPCheck}, b), qt.Not(qt.IsNil))
+}
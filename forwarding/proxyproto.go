@@ -0,0 +1,75 @@
+package forwarding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// streamSourcePrefix is the IPv6 prefix of the synthetic source addresses
+// sent in PROXY protocol headers. It is the same prefix Tor uses for
+// HiddenServiceExportCircuitID, which is not available to ephemeral onion
+// services. Here the last 32 bits are a connection sequence number assigned by
+// onionpipe, not anything Tor knows about: connections arriving on the same
+// Tor circuit still get different numbers, and numbering restarts with the
+// process.
+var streamSourcePrefix = net.IP{0xfc, 0x00, 0xde, 0xad, 0xbe, 0xef, 0x4d, 0xad, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// proxyHeader returns a PROXY protocol header identifying a stream relayed
+// from an onion port. The source is a synthetic address which encodes the
+// stream's sequence number, and the destination is the onion port on the
+// local host. A version 2 header also carries the onion host name, and the
+// sequence number as a unique ID.
+func proxyHeader(version config.ProxyProtocol, streamID uint32, onionHost string, onionPort int) []byte {
+	src := streamSource(streamID)
+	srcPort := uint16(streamID)
+	dst := net.IPv6loopback
+
+	switch version {
+	case config.ProxyProtocolV1:
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src, dst, srcPort, onionPort))
+	case config.ProxyProtocolV2:
+		var tlvs bytes.Buffer
+		writeTLV(&tlvs, pp2TypeAuthority, []byte(onionHost))
+		id := make([]byte, 4)
+		binary.BigEndian.PutUint32(id, streamID)
+		writeTLV(&tlvs, pp2TypeUniqueID, id)
+
+		var buf bytes.Buffer
+		buf.Write(pp2Signature)
+		buf.WriteByte(0x21) // version 2, PROXY command
+		buf.WriteByte(0x21) // AF_INET6, STREAM
+		binary.Write(&buf, binary.BigEndian, uint16(2*net.IPv6len+4+tlvs.Len()))
+		buf.Write(src)
+		buf.Write(dst)
+		binary.Write(&buf, binary.BigEndian, srcPort)
+		binary.Write(&buf, binary.BigEndian, uint16(onionPort))
+		buf.Write(tlvs.Bytes())
+		return buf.Bytes()
+	}
+	return nil
+}
+
+// streamSource returns the synthetic source address of a stream.
+func streamSource(streamID uint32) net.IP {
+	src := make(net.IP, net.IPv6len)
+	copy(src, streamSourcePrefix)
+	binary.BigEndian.PutUint32(src[12:], streamID)
+	return src
+}
+
+var pp2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	pp2TypeAuthority = 0x02
+	pp2TypeUniqueID  = 0x05
+)
+
+func writeTLV(buf *bytes.Buffer, typ byte, value []byte) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
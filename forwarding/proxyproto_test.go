@@ -0,0 +1,65 @@
+package forwarding
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+func TestProxyHeader(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("v1", func(c *qt.C) {
+		h := proxyHeader(config.ProxyProtocolV1, 0x12345678, "xxx.onion", 80)
+		c.Assert(string(h), qt.Equals, "PROXY TCP6 fc00:dead:beef:4dad::1234:5678 ::1 22136 80\r\n")
+	})
+
+	c.Run("v2", func(c *qt.C) {
+		h := proxyHeader(config.ProxyProtocolV2, 0x12345678, "xxx.onion", 443)
+		c.Assert(h[:12], qt.DeepEquals, pp2Signature)
+		c.Assert(h[12], qt.Equals, byte(0x21))
+		c.Assert(h[13], qt.Equals, byte(0x21))
+		length := binary.BigEndian.Uint16(h[14:16])
+		c.Assert(int(length), qt.Equals, len(h)-16)
+		addrs := h[16:]
+		c.Assert(net.IP(addrs[:16]).String(), qt.Equals, "fc00:dead:beef:4dad::1234:5678")
+		c.Assert(net.IP(addrs[16:32]).String(), qt.Equals, "::1")
+		c.Assert(binary.BigEndian.Uint16(addrs[32:34]), qt.Equals, uint16(0x5678))
+		c.Assert(binary.BigEndian.Uint16(addrs[34:36]), qt.Equals, uint16(443))
+		tlvs := addrs[36:]
+		c.Assert(tlvs[0], qt.Equals, byte(pp2TypeAuthority))
+		c.Assert(string(tlvs[3:3+binary.BigEndian.Uint16(tlvs[1:3])]), qt.Equals, "xxx.onion")
+		tlvs = tlvs[3+binary.BigEndian.Uint16(tlvs[1:3]):]
+		c.Assert(tlvs, qt.DeepEquals, []byte{pp2TypeUniqueID, 0, 4, 0x12, 0x34, 0x56, 0x78})
+	})
+
+	c.Run("pool sends header", func(c *qt.C) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, qt.IsNil)
+		defer l.Close()
+		headers := make(chan string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			headers <- line
+			io.Copy(io.Discard, conn)
+		}()
+		p := newTestPool(c, "", l.Addr().String())
+		p.proxy, p.onionHost = config.ProxyProtocolV1, "xxx.onion"
+		conn, err := p.dial(withStream(context.Background(), stream{id: 42, port: 8080}))
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		c.Assert(<-headers, qt.Equals, "PROXY TCP6 fc00:dead:beef:4dad::2a ::1 42 8080\r\n")
+	})
+}
@@ -0,0 +1,81 @@
+package forwarding
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bucket is a token bucket limiting the rate of bytes transferred. The rate is
+// shared, so that it may be adjusted while the bucket is in use. A zero rate
+// is unlimited.
+type bucket struct {
+	rate *atomic.Int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate *atomic.Int64) *bucket {
+	return &bucket{
+		rate:   rate,
+		tokens: float64(rate.Load()),
+		last:   time.Now(),
+	}
+}
+
+// burst returns the most bytes that may be taken at once, or zero if
+// unlimited. The bucket holds at most one second's worth of tokens.
+func (b *bucket) burst() int {
+	return int(b.rate.Load())
+}
+
+// take removes n tokens from the bucket, returning how long the caller should
+// wait before the bytes are transferred in order to conform to the rate.
+func (b *bucket) take(n int) time.Duration {
+	rate := b.rate.Load()
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// rateReader limits the rate of reads to conform to all of its buckets.
+type rateReader struct {
+	io.Reader
+	buckets []*bucket
+}
+
+// Read implements io.Reader.
+func (r *rateReader) Read(p []byte) (int, error) {
+	for _, b := range r.buckets {
+		if burst := b.burst(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		for _, b := range r.buckets {
+			if d := b.take(n); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,86 @@
+package forwarding
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+func TestBucket(t *testing.T) {
+	c := qt.New(t)
+	var rate atomic.Int64
+
+	b := newBucket(&rate)
+	c.Assert(b.take(1<<20), qt.Equals, time.Duration(0), qt.Commentf("unlimited"))
+
+	rate.Store(1000)
+	b = newBucket(&rate)
+	c.Assert(b.burst(), qt.Equals, 1000)
+	c.Assert(b.take(1000), qt.Equals, time.Duration(0), qt.Commentf("burst"))
+	wait := b.take(500)
+	c.Assert(wait > 400*time.Millisecond && wait <= 500*time.Millisecond, qt.IsTrue, qt.Commentf("wait %v", wait))
+
+	// Adjusting the rate takes effect on the next take.
+	rate.Store(0)
+	c.Assert(b.take(1<<20), qt.Equals, time.Duration(0))
+}
+
+func TestRelayRate(t *testing.T) {
+	c := qt.New(t)
+	echoAddr := startEcho(c)
+	r, addr := startRelay(c, config.Limits{ConnRate: 4096}, dialTCP(echoAddr))
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// The first second's worth is the burst, the rest must wait.
+	msg := bytes.Repeat([]byte("x"), 8192)
+	start := time.Now()
+	go conn.Write(msg)
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(time.Since(start) >= 900*time.Millisecond, qt.IsTrue, qt.Commentf("took %v", time.Since(start)))
+
+	// Lifting the limit applies to connections in progress.
+	r.setRates(0, 0)
+	start = time.Now()
+	go conn.Write(msg)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(time.Since(start) < 900*time.Millisecond, qt.IsTrue, qt.Commentf("took %v", time.Since(start)))
+}
+
+func TestReload(t *testing.T) {
+	c := qt.New(t)
+	fwd, err := config.ParseForward("8080~80@test")
+	c.Assert(err, qt.IsNil)
+	other, err := config.ParseForward("8081~80")
+	c.Assert(err, qt.IsNil)
+	s := New(nil, fwd, other)
+	r := newRelay(fwd.Description(nil), fwd.Limits(), nil)
+	s.relays[fwd] = r
+
+	reloaded, err := config.ParseForward("8080~80@test")
+	c.Assert(err, qt.IsNil)
+	reloaded.SetLimits(config.Limits{Rate: 1 << 20, ConnRate: 1 << 10})
+	s.Reload([]*config.Forward{reloaded})
+
+	c.Assert(s.Status(), qt.DeepEquals, []ForwardStatus{{
+		Forward:  fwd.Description(nil),
+		Relayed:  true,
+		Rate:     1 << 20,
+		ConnRate: 1 << 10,
+	}, {
+		Forward: other.Description(nil),
+	}})
+}
@@ -0,0 +1,350 @@
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// dialFunc connects to the far side of a relayed connection.
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+// relay accepts connections on a local listener and pipes each of them to a
+// connection obtained from dial, enforcing the forward's connection limits.
+type relay struct {
+	desc   string
+	limits config.Limits
+	retry  config.Retry
+	dial   dialFunc
+
+	conns    chan struct{}
+	active   atomic.Int64
+	rejected atomic.Uint64
+
+	// total, bytesIn, bytesOut and dialFailures are counters exposed as
+	// metrics.
+	total             atomic.Uint64
+	bytesIn, bytesOut atomic.Uint64
+	dialFailures      atomic.Uint64
+
+	rate, connRate     atomic.Int64
+	sendRate, recvRate *bucket
+
+	// access logs each relayed connection, if set.
+	access *accessLogger
+	// export is whether the relay is for an export, which connects to a
+	// local backend, rather than an import accepting local clients.
+	export bool
+}
+
+func newRelay(desc string, limits config.Limits, dial dialFunc) *relay {
+	r := &relay{
+		desc:   desc,
+		limits: limits,
+		dial:   dial,
+	}
+	if limits.MaxConns > 0 {
+		r.conns = make(chan struct{}, limits.MaxConns)
+	}
+	r.setRates(limits.Rate, limits.ConnRate)
+	r.sendRate, r.recvRate = newBucket(&r.rate), newBucket(&r.rate)
+	return r
+}
+
+// setRates sets the forward and per-connection rate limits, in bytes per
+// second. This takes effect immediately on connections already relayed.
+func (r *relay) setRates(rate, connRate int64) {
+	r.rate.Store(rate)
+	r.connRate.Store(connRate)
+}
+
+// streamIDs numbers the streams relayed by this process, in the order they are
+// accepted. These are local sequence numbers, unrelated to Tor's stream or
+// circuit IDs, which the control port does not expose for onion services.
+var streamIDs atomic.Uint32
+
+// stream describes a connection relayed through a forward.
+type stream struct {
+	// id is the stream's sequence number, unique within this process.
+	id uint32
+	// port is the onion port of the stream, or zero if unknown.
+	port int
+	// client is the address of the local client which connected.
+	client string
+}
+
+type streamKey struct{}
+
+func withStream(ctx context.Context, st stream) context.Context {
+	return context.WithValue(ctx, streamKey{}, st)
+}
+
+// streamFrom returns the stream being relayed in the context, if any.
+func streamFrom(ctx context.Context) (stream, bool) {
+	st, ok := ctx.Value(streamKey{}).(stream)
+	return st, ok
+}
+
+// serve relays connections accepted from the listener until the context is
+// done, at which point the listener is closed. The onion port relayed
+// through the listener is given, if known.
+func (r *relay) serve(ctx context.Context, l net.Listener, port int) {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("failed to accept on local address %q", l.Addr())
+			}
+			return
+		}
+		st := stream{id: streamIDs.Add(1), port: port, client: conn.RemoteAddr().String()}
+		if !r.acquire() {
+			rejected := r.rejected.Add(1)
+			log.Printf("%s: rejected connection from %q, limit of %d concurrent connections reached (%d rejected)",
+				r.desc, conn.RemoteAddr(), r.limits.MaxConns, rejected)
+			conn.Close()
+			if rec := r.startRecord(st); rec != nil {
+				r.finishRecord(rec, 0, 0, reasonRejected)
+			}
+			continue
+		}
+		go func() {
+			defer r.release()
+			r.handle(withStream(ctx, st), conn)
+		}()
+	}
+}
+
+func (r *relay) acquire() bool {
+	if r.conns == nil {
+		return true
+	}
+	select {
+	case r.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *relay) release() {
+	if r.conns != nil {
+		<-r.conns
+	}
+}
+
+func (r *relay) handle(ctx context.Context, localConn net.Conn) {
+	defer localConn.Close()
+	r.total.Add(1)
+	r.active.Add(1)
+	defer r.active.Add(-1)
+	st, _ := streamFrom(ctx)
+	rec := r.startRecord(st)
+	remoteConn, err := r.dialRetry(ctx)
+	if err != nil {
+		log.Printf("%s: %v", r.desc, err)
+		if rec != nil {
+			r.finishRecord(rec, 0, 0, fmt.Sprintf("%s: %v", reasonDialFailed, err))
+		}
+		return
+	}
+	defer remoteConn.Close()
+	if rec != nil && r.export {
+		rec.Peer = remoteConn.RemoteAddr().String()
+	}
+	in, out, reason := r.pipe(localConn, remoteConn)
+	if rec != nil {
+		r.finishRecord(rec, in, out, reason)
+	}
+}
+
+// startRecord starts an access log record for a stream, if the relay is
+// access logged.
+func (r *relay) startRecord(st stream) *accessRecord {
+	if r.access == nil {
+		return nil
+	}
+	rec := &accessRecord{Start: time.Now(), Forward: r.desc, Stream: st.id}
+	if !r.export {
+		rec.Peer = st.client
+	}
+	return rec
+}
+
+func (r *relay) finishRecord(rec *accessRecord, in, out int64, reason string) {
+	rec.End = time.Now()
+	rec.BytesIn, rec.BytesOut, rec.Reason = in, out, reason
+	r.access.log(rec)
+}
+
+// dialRetry dials the far side of the relay, retrying failed dials with
+// exponential backoff until the retry deadline, if any.
+func (r *relay) dialRetry(ctx context.Context) (net.Conn, error) {
+	if r.retry.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.retry.Deadline)
+		defer cancel()
+	}
+	for retry := 1; ; retry++ {
+		conn, err := r.dialOnce(ctx)
+		if err == nil || r.retry.Deadline == 0 {
+			return conn, err
+		}
+		backoff := r.retry.Backoff(retry)
+		log.Printf("%s: %v; retrying in %v", r.desc, err, backoff)
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("giving up after %d attempts: %w", retry, err)
+		case <-t.C:
+		}
+	}
+}
+
+func (r *relay) dialOnce(ctx context.Context) (net.Conn, error) {
+	if r.limits.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.limits.DialTimeout)
+		defer cancel()
+	}
+	conn, err := r.dial(ctx)
+	if err != nil {
+		r.dialFailures.Add(1)
+	}
+	return conn, err
+}
+
+// prewarm dials the far side of the relay once and closes the connection,
+// so that subsequent connections are made more quickly.
+func (r *relay) prewarm(ctx context.Context) {
+	conn, err := r.dialRetry(ctx)
+	if err != nil {
+		log.Printf("%s: prewarm failed: %v", r.desc, err)
+		return
+	}
+	conn.Close()
+	log.Printf("%s: prewarmed", r.desc)
+}
+
+// pipe copies data in both directions between the connections until either
+// direction is done, or the connection exceeds its idle timeout or lifetime.
+// The bytes received from and sent to the local connection are returned,
+// with the reason the connection was closed.
+func (r *relay) pipe(localConn, remoteConn net.Conn) (in, out int64, reason string) {
+	var once sync.Once
+	closeWith := func(why string) {
+		once.Do(func() {
+			reason = why
+			localConn.Close()
+			remoteConn.Close()
+		})
+	}
+	if r.limits.MaxLifetime > 0 {
+		t := time.AfterFunc(r.limits.MaxLifetime, func() { closeWith(reasonLifetime) })
+		defer t.Stop()
+	}
+	touch := func() {}
+	if r.limits.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		touch = watchIdle(r.limits.IdleTimeout, stop, func() { closeWith(reasonIdle) })
+	}
+
+	recvDone := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(localConn, &rateReader{
+			Reader:  &activityReader{Reader: remoteConn, touch: touch, count: &r.bytesOut},
+			buckets: []*bucket{r.recvRate, newBucket(&r.connRate)},
+		})
+		out = n
+		recvDone <- err
+	}()
+	sendDone := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(remoteConn, &rateReader{
+			Reader:  &activityReader{Reader: localConn, touch: touch, count: &r.bytesIn},
+			buckets: []*bucket{r.sendRate, newBucket(&r.connRate)},
+		})
+		in = n
+		sendDone <- err
+	}()
+	// Once either direction is done, close both so that the other finishes
+	// too.
+	var err error
+	select {
+	case err = <-recvDone:
+		closeWith(closeReason(err))
+		<-sendDone
+	case err = <-sendDone:
+		closeWith(closeReason(err))
+		<-recvDone
+	}
+	return in, out, reason
+}
+
+func closeReason(err error) string {
+	if err != nil {
+		return fmt.Sprintf("%s: %v", reasonCopyFailure, err)
+	}
+	return reasonClosed
+}
+
+// watchIdle calls onIdle if the returned touch function is not called at
+// least once every timeout, until stop is closed.
+func watchIdle(timeout time.Duration, stop <-chan struct{}, onIdle func()) (touch func()) {
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	go func() {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				idle := time.Since(time.Unix(0, last.Load()))
+				if idle >= timeout {
+					onIdle()
+					return
+				}
+				t.Reset(timeout - idle)
+			}
+		}
+	}()
+	return func() {
+		last.Store(time.Now().UnixNano())
+	}
+}
+
+// activityReader calls touch whenever data is read, and adds the bytes read
+// to count.
+type activityReader struct {
+	io.Reader
+	touch func()
+	count *atomic.Uint64
+}
+
+// Read implements io.Reader.
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+		if r.count != nil {
+			r.count.Add(uint64(n))
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,211 @@
+package forwarding
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// startEcho starts a local TCP server which echoes back what it receives.
+func startEcho(c *qt.C) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startRelay starts a relay to the given address, returning the address to
+// connect to it.
+func startRelay(c *qt.C, limits config.Limits, dial dialFunc) (*relay, string) {
+	r := newRelay("test", limits, dial)
+	return r, serveRelay(c, r)
+}
+
+// serveRelay serves a relay, returning the address to connect to it.
+func serveRelay(c *qt.C, r *relay) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	go r.serve(ctx, l, 0)
+	return l.Addr().String()
+}
+
+func dialTCP(addr string) dialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}
+}
+
+func assertEcho(c *qt.C, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, msg)
+}
+
+func assertClosed(c *qt.C, conn net.Conn, within time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(within))
+	_, err := conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+}
+
+func TestRelay(t *testing.T) {
+	c := qt.New(t)
+	echoAddr := startEcho(c)
+
+	c.Run("no limits", func(c *qt.C) {
+		_, addr := startRelay(c, config.Limits{}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertEcho(c, conn, "hello world")
+	})
+
+	c.Run("max conns", func(c *qt.C) {
+		r, addr := startRelay(c, config.Limits{MaxConns: 1}, dialTCP(echoAddr))
+		conn1, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn1.Close()
+		assertEcho(c, conn1, "first")
+
+		conn2, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn2.Close()
+		assertClosed(c, conn2, 5*time.Second)
+		c.Assert(r.rejected.Load(), qt.Equals, uint64(1))
+
+		// Once the first connection is done, another may be made.
+		conn1.Close()
+		c.Assert(waitFor(func() bool { return len(r.conns) == 0 }), qt.IsTrue)
+		conn3, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn3.Close()
+		assertEcho(c, conn3, "third")
+	})
+
+	c.Run("idle timeout", func(c *qt.C) {
+		_, addr := startRelay(c, config.Limits{IdleTimeout: 200 * time.Millisecond}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		for i := 0; i < 5; i++ {
+			assertEcho(c, conn, "still here")
+			time.Sleep(100 * time.Millisecond)
+		}
+		assertClosed(c, conn, 5*time.Second)
+	})
+
+	c.Run("max lifetime", func(c *qt.C) {
+		_, addr := startRelay(c, config.Limits{MaxLifetime: 300 * time.Millisecond}, dialTCP(echoAddr))
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertEcho(c, conn, "short lived")
+		start := time.Now()
+		assertClosed(c, conn, 5*time.Second)
+		c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue)
+	})
+
+	c.Run("dial timeout", func(c *qt.C) {
+		_, addr := startRelay(c, config.Limits{DialTimeout: 100 * time.Millisecond},
+			func(ctx context.Context) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertClosed(c, conn, 5*time.Second)
+	})
+}
+
+func TestRelayRetry(t *testing.T) {
+	c := qt.New(t)
+	echoAddr := startEcho(c)
+
+	var attempts atomic.Int32
+	flaky := func(ctx context.Context) (net.Conn, error) {
+		if attempts.Add(1) < 3 {
+			return nil, errors.New("descriptor not yet available")
+		}
+		return dialTCP(echoAddr)(ctx)
+	}
+
+	c.Run("retry until success", func(c *qt.C) {
+		attempts.Store(0)
+		r := newRelay("test", config.Limits{}, flaky)
+		r.retry = config.Retry{Deadline: 5 * time.Second, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		addr := serveRelay(c, r)
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertEcho(c, conn, "third time's the charm")
+		c.Assert(attempts.Load(), qt.Equals, int32(3))
+	})
+
+	c.Run("no retry", func(c *qt.C) {
+		attempts.Store(0)
+		_, addr := startRelay(c, config.Limits{}, flaky)
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertClosed(c, conn, 5*time.Second)
+		c.Assert(attempts.Load(), qt.Equals, int32(1))
+	})
+
+	c.Run("retry deadline", func(c *qt.C) {
+		attempts.Store(-100)
+		r := newRelay("test", config.Limits{}, flaky)
+		r.retry = config.Retry{Deadline: 200 * time.Millisecond, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		addr := serveRelay(c, r)
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertClosed(c, conn, 5*time.Second)
+		c.Assert(attempts.Load() > -100 && attempts.Load() < 3, qt.IsTrue)
+	})
+
+	c.Run("prewarm", func(c *qt.C) {
+		attempts.Store(0)
+		r := newRelay("test", config.Limits{}, flaky)
+		r.retry = config.Retry{Deadline: 5 * time.Second, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+		r.prewarm(context.Background())
+		c.Assert(attempts.Load(), qt.Equals, int32(3))
+	})
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
@@ -2,11 +2,12 @@ package forwarding
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/cretz/bine/tor"
@@ -25,6 +26,21 @@ type Service struct {
 	nonAnonymous bool
 	authClients  []string
 	done         chan struct{}
+
+	runDir      string
+	sockets     int
+	relays      map[*config.Forward]*relay
+	aliasOnions map[string]string
+	onions      map[string]*onion
+
+	// metrics enables collecting metrics from Tor events, and descriptors
+	// counts the descriptor uploads of each published onion.
+	metrics     bool
+	descriptors *descriptorStats
+
+	// accessWriters are shared by forwards logging to the same file, or
+	// stderr.
+	accessWriters map[string]*accessWriter
 }
 
 // New returns a new forwarding service.
@@ -42,6 +58,10 @@ func New(t *tor.Tor, fwds ...*config.Forward) *Service {
 		imports: imports,
 		exports: exports,
 		done:    make(chan struct{}),
+		relays:  map[*config.Forward]*relay{},
+
+		descriptors:   newDescriptorStats(),
+		accessWriters: map[string]*accessWriter{},
 	}
 }
 
@@ -64,6 +84,13 @@ func AuthClients(authClients []string) Option {
 	}
 }
 
+// CollectMetrics configures this service to collect metrics from Tor, such
+// as onion service descriptor uploads, and to relay exports which Tor would
+// otherwise connect to directly, so that their connections are counted.
+func CollectMetrics(s *Service) {
+	s.metrics = true
+}
+
 // Start starts forwarding.
 func (s *Service) Start(ctx context.Context, options ...Option) (map[string]string, error) {
 	for i := range options {
@@ -81,20 +108,13 @@ func (s *Service) Start(ctx context.Context, options ...Option) (map[string]stri
 	}
 	// Start export forwarding
 	if len(s.exports) > 0 {
-		aliasOnions := map[string]string{}
-		onionFwds, err := s.startExporter(ctx)
-		if err != nil {
-			return nil, err
-		}
-		for alias, fwd := range onionFwds {
-			aliasOnions[alias] = fwd.ID
-		}
-		return aliasOnions, nil
+		return s.startExporter(ctx)
 	} else {
 		// If there are no export forwards, pass "context done" through to
 		// "service done".
 		go func() {
 			<-ctx.Done()
+			s.closeAccessLogs()
 			close(s.done)
 		}()
 	}
@@ -118,81 +138,139 @@ func (s *Service) startImporter(ctx context.Context, t *tor.Tor, fwd *config.For
 		return fmt.Errorf("destination: %w", err)
 	}
 
+	var tlsConf *tls.Config
+	if lt := fwd.LocalTLS(); lt != nil {
+		// The certificate names the destination as it was configured, and
+		// the address it resolved to, which clients may connect to instead.
+		host, _, _ := net.SplitHostPort(destAddr)
+		tlsConf, err = localTLSConfig(fwd.Description(nil), lt, fwd.Destination().HostName(), host)
+		if err != nil {
+			return err
+		}
+	}
+	var remoteTLSConf *tls.Config
+	if rt := fwd.RemoteTLS(); rt != nil {
+		onionHost, _, _ := net.SplitHostPort(srcAddr)
+		remoteTLSConf, err = remoteTLSConfig(rt, onionHost)
+		if err != nil {
+			return err
+		}
+	}
 	l, err := net.Listen("tcp", destAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on local address %q", destAddr)
 	}
-	remoteDialer, err := t.Dialer(ctx, nil)
+	if tlsConf != nil {
+		l = tls.NewListener(l, tlsConf)
+	}
+	if err := t.EnableNetwork(ctx, true); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to enable tor network: %w", err)
+	}
+	socksNetwork, socksAddr, err := socksProxyAddr(t)
 	if err != nil {
-		return fmt.Errorf("failed to create tor network dialer")
+		l.Close()
+		return fmt.Errorf("failed to create tor network dialer: %w", err)
 	}
 
-	go func() {
-		for {
-			localConn, err := l.Accept()
-			if err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					log.Printf("failed to accept on local address %q", destAddr)
-				}
-				return
-			}
-			go func() {
-				defer localConn.Close()
-				remoteConn, err := remoteDialer.DialContext(ctx, "tcp", srcAddr)
-				if err != nil {
-					log.Printf("failed to connect to onion address %q", srcAddr)
-					return
-				}
-				defer remoteConn.Close()
-
-				recvDone := make(chan struct{})
-				go func() {
-					io.Copy(localConn, remoteConn)
-					close(recvDone)
-				}()
-				sendDone := make(chan struct{})
-				go func() {
-					io.Copy(remoteConn, localConn)
-					close(sendDone)
-				}()
-				select {
-				case <-recvDone:
-				case <-sendDone:
-				}
-			}()
+	isolation := fwd.Isolation()
+	r := newRelay(fwd.Description(nil), fwd.Limits(), func(ctx context.Context) (net.Conn, error) {
+		st, _ := streamFrom(ctx)
+		// Tor isolates streams by SOCKS credentials, so each isolation key
+		// needs its own dialer. These are cheap to make, as the SOCKS address
+		// is only looked up once.
+		dialer, err := t.Dialer(ctx, &tor.DialConf{
+			ProxyNetwork:      socksNetwork,
+			ProxyAddress:      socksAddr,
+			ProxyAuth:         isolationAuth(isolation, srcAddr, st),
+			SkipEnableNetwork: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tor network dialer: %w", err)
 		}
-	}()
-
-	go func() {
-		<-ctx.Done()
+		conn, err := dialer.DialContext(ctx, "tcp", srcAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to onion address %q", srcAddr)
+		}
+		if remoteTLSConf != nil {
+			return originateTLS(ctx, conn, remoteTLSConf)
+		}
+		return conn, nil
+	})
+	r.retry = fwd.Retry()
+	r.access, err = s.accessLogger(fwd.AccessLog())
+	if err != nil {
 		l.Close()
-	}()
-
+		return err
+	}
+	s.relays[fwd] = r
+	go r.serve(ctx, l, fwd.Source().Ports()[0])
+	if fwd.Prewarm() {
+		go r.prewarm(ctx)
+	}
 	return nil
 }
 
 const exportTimeout = 3 * time.Minute
 
-func (s *Service) startExporter(ctx context.Context) (map[string]*tor.OnionForward, error) {
+func (s *Service) startExporter(ctx context.Context) (_ map[string]string, err error) {
 	// Wait at most a few minutes to publish the service
 	exportCtx, cancel := context.WithTimeout(ctx, exportTimeout)
 	defer cancel()
 
+	relayListeners := map[*config.Forward][]relayListener{}
+	locationListeners := map[*config.Forward]net.Listener{}
+	accessLoggers := map[*config.Forward]*accessLogger{}
+	defer func() {
+		if err != nil {
+			for _, ls := range relayListeners {
+				for _, rl := range ls {
+					rl.Close()
+				}
+			}
+			for _, l := range locationListeners {
+				l.Close()
+			}
+			s.removeRunDir()
+			s.closeAccessLogs()
+		}
+	}()
+
 	// Build a port map for remote onion forwards, per service alias
 	serviceFwds := map[string]map[string][]int{}
 	serviceKeys := map[string][]byte{}
 	for _, export := range s.exports {
-		srcAddr, err := export.Source().SingleAddr()
+		targets, err := exportTargets(export)
 		if err != nil {
 			return nil, err
 		}
-		if export.Source().IsUnix() {
-			srcAddr = "unix:" + srcAddr
+		if s.relayed(export) {
+			// Limits, backend selection and such are handled by relaying
+			// through local sockets, rather than having Tor connect
+			// directly to the source.
+			ls, relayTargets, err := s.listenRelays(export)
+			relayListeners[export] = ls
+			if err != nil {
+				return nil, err
+			}
+			targets = relayTargets
+		}
+		if accessLoggers[export], err = s.accessLogger(export.AccessLog()); err != nil {
+			return nil, err
+		}
+		if loc := export.OnionLocation(); !loc.IsZero() {
+			// Listen for clearnet clients before publishing, so that the
+			// address being in use is an error up front.
+			listenAddr, _ := loc.Listen.SingleAddr()
+			l, err := net.Listen("tcp", listenAddr)
+			if err != nil {
+				return nil, fmt.Errorf("failed to listen on local address %q: %w", listenAddr, err)
+			}
+			locationListeners[export] = l
 		}
 		exportFwds, ok := serviceFwds[export.Destination().Alias()]
 		if !ok {
 			exportFwds = map[string][]int{}
-			exportFwds[srcAddr] = export.Destination().Ports()
 			serviceFwds[export.Destination().Alias()] = exportFwds
 			if key := export.Destination().ServiceKey(); len(key) > 0 {
 				serviceKeys[export.Destination().Alias()] = key
@@ -202,11 +280,21 @@ func (s *Service) startExporter(ctx context.Context) (map[string]*tor.OnionForwa
 				defer zeroize(key)
 			}
 		}
-		exportFwds[srcAddr] = export.Destination().Ports()
+		for addr, ports := range targets {
+			exportFwds[addr] = ports
+		}
+	}
+
+	if s.metrics {
+		// Watch descriptor uploads before publishing, to count the first.
+		if err := s.watchDescriptors(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	// Forward onion services
-	fwds := map[string]*tor.OnionForward{}
+	onions := map[string]*onion{}
+	aliasOnions := map[string]string{}
 	for alias, exportFwds := range serviceFwds {
 		var key interface{}
 		if aliasKey, ok := serviceKeys[alias]; ok {
@@ -214,30 +302,347 @@ func (s *Service) startExporter(ctx context.Context) (map[string]*tor.OnionForwa
 		} else {
 			key = nil
 		}
-		fwd, err := s.tor.Forward(exportCtx, &tor.ForwardConf{
+		o := newOnion(s.tor, alias, &tor.ForwardConf{
 			PortForwards: exportFwds,
 			Key:          key,
 			NonAnonymous: s.nonAnonymous,
 			ClientAuths:  s.authClients,
 		})
-		if err != nil {
-			return nil, fmt.Errorf("Failed to create onion forward: %v", err)
+		if err := o.publish(exportCtx); err != nil {
+			for _, o := range onions {
+				o.close()
+			}
+			return nil, err
+		}
+		onions[alias] = o
+		aliasOnions[alias] = o.id
+	}
+
+	// Relay connections from Tor to the exported sources, now that the
+	// onion addresses are known.
+	for export, ls := range relayListeners {
+		alias := export.Destination().Alias()
+		s.startRelay(ctx, export, export.Description(aliasOnions), onions[alias], ls, accessLoggers[export])
+	}
+	for export, l := range locationListeners {
+		desc := export.Description(aliasOnions)
+		loc := export.OnionLocation()
+		backendEndp := loc.Backend
+		if backendEndp == nil {
+			backendEndp = export.Source()
 		}
-		fwds[alias] = fwd
+		base := onionURL(aliasOnions[export.Destination().Alias()], export.Destination().Ports()[0])
+		log.Printf("%s: adding Onion-Location %s to responses on %s", desc, base, l.Addr())
+		go newOnionLocation(desc, newBackend(backendEndp), base).serve(ctx, l)
 	}
+	s.aliasOnions = aliasOnions
+	s.onions = onions
 
 	go func() {
 		<-ctx.Done()
 		// Shut down forward w/context. Then indicate the service is done. This
 		// is necessary to coordinate a clean shutdown; if the forwards close
 		// after tor is closed, the process may panic.
-		for _, fwd := range fwds {
-			fwd.Close()
+		for _, o := range onions {
+			o.close()
 		}
+		s.removeRunDir()
+		s.closeAccessLogs()
 		close(s.done)
 	}()
 
-	return fwds, nil
+	return aliasOnions, nil
+}
+
+// ForwardStatus describes the runtime status of a forward.
+type ForwardStatus struct {
+	// Forward is the description of the forward.
+	Forward string `json:"forward"`
+	// Relayed is whether onionpipe relays the forward's connections, rather
+	// than Tor connecting directly to an exported source. Connection counts
+	// and limits only apply to relayed forwards.
+	Relayed bool `json:"relayed"`
+	// ActiveConns is the number of connections currently relayed.
+	ActiveConns int64 `json:"activeConns"`
+	// TotalConns is the number of connections relayed since the forward
+	// started, not counting those rejected.
+	TotalConns uint64 `json:"totalConns"`
+	// BytesIn and BytesOut are the bytes received from and sent to the
+	// clients of the forward.
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// DialFailures is the number of failed attempts to connect to the far
+	// side of the forward.
+	DialFailures uint64 `json:"dialFailures"`
+	// Rejected is the number of connections rejected due to the connection
+	// limit.
+	Rejected uint64 `json:"rejected"`
+	// Rate is the forward's rate limit in bytes per second, or zero if
+	// unlimited.
+	Rate int64 `json:"rate,omitempty"`
+	// ConnRate is the per-connection rate limit in bytes per second, or zero
+	// if unlimited.
+	ConnRate int64 `json:"connRate,omitempty"`
+}
+
+// Status returns the runtime status of all forwards in the service.
+func (s *Service) Status() []ForwardStatus {
+	var statuses []ForwardStatus
+	for _, fwd := range append(append([]*config.Forward{}, s.imports...), s.exports...) {
+		r, ok := s.relays[fwd]
+		if !ok {
+			statuses = append(statuses, ForwardStatus{Forward: fwd.Description(s.aliasOnions)})
+			continue
+		}
+		statuses = append(statuses, ForwardStatus{
+			Forward:      r.desc,
+			Relayed:      true,
+			ActiveConns:  r.active.Load(),
+			TotalConns:   r.total.Load(),
+			BytesIn:      r.bytesIn.Load(),
+			BytesOut:     r.bytesOut.Load(),
+			DialFailures: r.dialFailures.Load(),
+			Rejected:     r.rejected.Load(),
+			Rate:         r.rate.Load(),
+			ConnRate:     r.connRate.Load(),
+		})
+	}
+	return statuses
+}
+
+// Reload applies the rate limits of the given forwards to the matching
+// forwards already operating in the service. Forwards are matched by their
+// source, destination and alias. Other changes to forwards require a
+// restart, and are logged but otherwise ignored.
+func (s *Service) Reload(fwds []*config.Forward) {
+	running := map[string]*config.Forward{}
+	for _, fwd := range append(append([]*config.Forward{}, s.imports...), s.exports...) {
+		running[forwardKey(fwd)] = fwd
+	}
+	for _, fwd := range fwds {
+		key := forwardKey(fwd)
+		current, ok := running[key]
+		if !ok {
+			log.Printf("reload: forward %q is not running, restart to add it", key)
+			continue
+		}
+		delete(running, key)
+		limits := fwd.Limits()
+		r, ok := s.relays[current]
+		if !ok {
+			if limits.Rate > 0 || limits.ConnRate > 0 {
+				log.Printf("reload: forward %q is not relayed, restart to apply rate limits", key)
+			}
+			continue
+		}
+		r.setRates(limits.Rate, limits.ConnRate)
+		log.Printf("reload: forward %q rate %d bytes/s, connection rate %d bytes/s", key, limits.Rate, limits.ConnRate)
+	}
+}
+
+// forwardKey identifies a forward independently of its assigned onion
+// address.
+func forwardKey(fwd *config.Forward) string {
+	key := fwd.Description(nil)
+	if alias := fwd.Destination().Alias(); alias != "" {
+		key += "@" + alias
+	}
+	return key
+}
+
+// exportTargets returns the onion ports Tor forwards to each of an export's
+// source addresses.
+func exportTargets(export *config.Forward) (map[string][]int, error) {
+	src, destPorts := export.Source(), export.Destination().Ports()
+	if len(src.Ports()) > 1 {
+		// Each port of a source range or port map is forwarded to the
+		// matching onion port, directly by Tor.
+		if needsRelay(export) || !export.OnionLocation().IsZero() {
+			return nil, fmt.Errorf("%s: several source ports cannot be relayed; remove limits and other options which need relaying",
+				export.Description(nil))
+		}
+		addrs, err := src.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		targets := map[string][]int{}
+		for i := range addrs {
+			targets[addrs[i]] = []int{destPorts[i]}
+		}
+		return targets, nil
+	}
+	srcAddr, err := src.SingleAddr()
+	if err != nil {
+		return nil, err
+	}
+	if src.IsUnix() {
+		srcAddr = "unix:" + srcAddr
+	}
+	return map[string][]int{srcAddr: destPorts}, nil
+}
+
+// listenRelays listens for the connections Tor forwards to an export which
+// is relayed, returning the listeners and the onion ports Tor forwards to
+// each. Listeners are returned along with any error, to be closed.
+func (s *Service) listenRelays(export *config.Forward) ([]relayListener, map[string][]int, error) {
+	var ls []relayListener
+	targets := map[string][]int{}
+	portSets := [][]int{export.Destination().Ports()}
+	if export.ProxyProtocol() != config.NoProxyProtocol {
+		// Relay each onion port separately, so that the port each
+		// connection came in on is known.
+		portSets = nil
+		for _, port := range export.Destination().Ports() {
+			portSets = append(portSets, []int{port})
+		}
+	}
+	for _, ports := range portSets {
+		l, err := s.listenRelay()
+		if err != nil {
+			return ls, nil, err
+		}
+		rl := relayListener{Listener: l}
+		if len(ports) == 1 {
+			rl.port = ports[0]
+		}
+		ls = append(ls, rl)
+		targets["unix:"+l.Addr().String()] = ports
+	}
+	return ls, targets, nil
+}
+
+// startRelay relays connections accepted on an export's relay listeners to
+// its backends, once it is published as the given onion.
+func (s *Service) startRelay(ctx context.Context, export *config.Forward, desc string, o *onion, ls []relayListener, access *accessLogger) {
+	p := newPool(desc, export)
+	if o != nil {
+		p.onionHost = o.id + ".onion"
+	}
+	if p.health.Policy == config.Unpublish {
+		p.onAvailable = func(available bool) {
+			o.setAvailable(ctx, export, available)
+		}
+	}
+	p.checkHealth(ctx)
+	dial := p.dial
+	if export.Type() == config.HTTPForward {
+		h := newHTTPProxy(desc, export.HTTPProxy(), p)
+		go h.serve(ctx)
+		dial = h.dial
+	}
+	r := newRelay(desc, export.Limits(), dial)
+	r.export = true
+	r.access = access
+	s.relays[export] = r
+	for _, rl := range ls {
+		go r.serve(ctx, rl, rl.port)
+	}
+}
+
+// relayed returns whether an export's connections are relayed by this
+// service. Exports are relayed when they need to be, and also when metrics
+// are collected, so that their connections are counted. Exports of several
+// source ports cannot be relayed, and are not counted.
+func (s *Service) relayed(export *config.Forward) bool {
+	if s.metrics && len(export.Source().Ports()) == 1 {
+		return true
+	}
+	return needsRelay(export)
+}
+
+// needsRelay returns whether an export's connections must be relayed by
+// onionpipe, rather than by Tor connecting directly to the source.
+func needsRelay(export *config.Forward) bool {
+	return !export.Limits().IsZero() || len(export.Backends()) > 1 || !export.HealthCheck().IsZero() ||
+		export.ProxyProtocol() != config.NoProxyProtocol || export.Type() == config.HTTPForward ||
+		!export.AccessLog().IsZero() || resolvesLazily(export)
+}
+
+// resolvesLazily returns whether any of an export's backends are resolved
+// when connecting, which Tor cannot do itself.
+func resolvesLazily(export *config.Forward) bool {
+	for _, endp := range export.Backends() {
+		if endp.Resolution().Lazy {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogger returns the access logger configured for a forward, or nil if
+// it is not access logged.
+func (s *Service) accessLogger(al config.AccessLog) (*accessLogger, error) {
+	if al.IsZero() {
+		return nil, nil
+	}
+	w, ok := s.accessWriters[al.File]
+	if ok && al.File != "" && !sameRotation(w, al) {
+		// A file can only be rotated one way.
+		return nil, fmt.Errorf("access log %q is rotated differently by another forward", al.File)
+	}
+	if !ok {
+		w = &accessWriter{w: os.Stderr, maxSize: al.MaxSize, maxBackups: al.MaxBackups}
+		if al.File != "" {
+			f, err := openRotatingFile(al.File, al.MaxSize, al.MaxBackups)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open access log: %w", err)
+			}
+			w.w = f
+		}
+		s.accessWriters[al.File] = w
+	}
+	return &accessLogger{format: al.Format, out: w}, nil
+}
+
+// sameRotation returns whether an access log is rotated in the same way as
+// the file written by w.
+func sameRotation(w *accessWriter, al config.AccessLog) bool {
+	if w.maxSize != al.MaxSize {
+		return false
+	}
+	// Backups are only kept of rotated files.
+	return al.MaxSize == 0 || w.maxBackups == al.MaxBackups
+}
+
+func (s *Service) closeAccessLogs() {
+	for _, w := range s.accessWriters {
+		w.close()
+	}
+}
+
+// relayListener is a listener for connections from Tor to be relayed, and
+// the onion port relayed through it, if it relays a single port.
+type relayListener struct {
+	net.Listener
+	port int
+}
+
+// listenRelay listens on a new UNIX socket in a private runtime directory,
+// which is created on first use and removed when the service shuts down.
+func (s *Service) listenRelay() (net.Listener, error) {
+	if s.runDir == "" {
+		runDir, err := os.MkdirTemp("", "onionpipe-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create runtime directory: %w", err)
+		}
+		s.runDir = runDir
+	}
+	s.sockets++
+	path := filepath.Join(s.runDir, fmt.Sprintf("relay%d.sock", s.sockets))
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on relay socket %q: %w", path, err)
+	}
+	return l, nil
+}
+
+func (s *Service) removeRunDir() {
+	if s.runDir == "" {
+		return
+	}
+	if err := os.RemoveAll(s.runDir); err != nil {
+		log.Printf("failed to remove runtime directory: %v", err)
+	}
 }
 
 var zeroKey ed25519.PrivateKey
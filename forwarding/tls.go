@@ -0,0 +1,147 @@
+package forwarding
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// localTLSConfig returns the TLS configuration for terminating TLS on an
+// import's local destination. A self-signed certificate is generated for the
+// destination's hosts unless one is given; its fingerprint is logged so that
+// clients may pin it. The hosts are the host name the destination was
+// configured with, followed by the address it resolved to.
+func localTLSConfig(desc string, lt *config.LocalTLS, hosts ...string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if lt.SelfSigned() {
+		cert, err = selfSignedCert(hosts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate certificate: %w", err)
+		}
+		log.Printf("%s: serving self-signed certificate for %q, sha256 fingerprint %s",
+			desc, hosts, certFingerprint(cert.Certificate[0]))
+	} else {
+		cert, err = tls.LoadX509KeyPair(lt.CertFile, lt.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificate: %w", err)
+		}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// selfSignedCert generates a certificate for host names and IP addresses,
+// valid for a year. The first host is the certificate's common name.
+// localhost and the loopback addresses are always included.
+func selfSignedCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"onionpipe"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !slices.ContainsFunc(tmpl.IPAddresses, ip.Equal) {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			}
+		} else if host != "" && !slices.Contains(tmpl.DNSNames, host) {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// certFingerprint returns the hex SHA-256 digest of a DER certificate.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// remoteTLSConfig returns the TLS configuration for originating TLS to an
+// imported onion. The onion's certificate is verified by the CA bundle, if
+// given, and must match the pinned fingerprint, if given.
+func remoteTLSConfig(rt *config.RemoteTLS, onionHost string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: rt.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = onionHost
+	}
+	if rt.CAFile != "" {
+		pemCerts, err := os.ReadFile(rt.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", rt.CAFile)
+		}
+	} else {
+		// The pinned fingerprint is checked instead of a chain of trust.
+		conf.InsecureSkipVerify = true
+	}
+	if len(rt.Fingerprint) > 0 {
+		fingerprint := hex.EncodeToString(rt.Fingerprint)
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("no certificate presented")
+			}
+			if got := certFingerprint(cs.PeerCertificates[0].Raw); got != fingerprint {
+				return fmt.Errorf("certificate fingerprint %s does not match pinned fingerprint %s", got, fingerprint)
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// originateTLS performs a TLS handshake over a connection to an onion,
+// closing the connection if it fails.
+func originateTLS(ctx context.Context, conn net.Conn, conf *tls.Config) (net.Conn, error) {
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,183 @@
+package forwarding
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/cmars/onionpipe/config"
+)
+
+// serveTLSRelay serves a relay to the given address behind local TLS
+// termination, returning the relay address.
+func serveTLSRelay(c *qt.C, conf *tls.Config, addr string) string {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Cleanup(cancel)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	go newRelay("test", config.Limits{}, dialTCP(addr)).serve(ctx, tls.NewListener(l, conf), 0)
+	return l.Addr().String()
+}
+
+func TestLocalTLS(t *testing.T) {
+	c := qt.New(t)
+	echoAddr := startEcho(c)
+
+	c.Run("self-signed", func(c *qt.C) {
+		lt, err := config.NewLocalTLS("", "")
+		c.Assert(err, qt.IsNil)
+		conf, err := localTLSConfig("test", lt, "127.0.0.1")
+		c.Assert(err, qt.IsNil)
+		addr := serveTLSRelay(c, conf, echoAddr)
+
+		leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+		c.Assert(err, qt.IsNil)
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertEcho(c, conn, "hello over tls")
+
+		// The certificate is also valid for localhost.
+		c.Assert(leaf.VerifyHostname("localhost"), qt.IsNil)
+	})
+
+	c.Run("self-signed host name", func(c *qt.C) {
+		lt, err := config.NewLocalTLS("", "")
+		c.Assert(err, qt.IsNil)
+		conf, err := localTLSConfig("test", lt, "app.internal", "10.0.0.5")
+		c.Assert(err, qt.IsNil)
+		leaf, err := x509.ParseCertificate(conf.Certificates[0].Certificate[0])
+		c.Assert(err, qt.IsNil)
+		c.Assert(leaf.Subject.CommonName, qt.Equals, "app.internal")
+		for _, host := range []string{"app.internal", "10.0.0.5", "localhost", "127.0.0.1"} {
+			c.Assert(leaf.VerifyHostname(host), qt.IsNil, qt.Commentf("%s", host))
+		}
+	})
+
+	c.Run("certificate files", func(c *qt.C) {
+		cert, err := selfSignedCert("app.internal")
+		c.Assert(err, qt.IsNil)
+		dir := c.Mkdir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		c.Assert(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600), qt.IsNil)
+		keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		c.Assert(err, qt.IsNil)
+		c.Assert(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600), qt.IsNil)
+
+		lt, err := config.NewLocalTLS(certFile, keyFile)
+		c.Assert(err, qt.IsNil)
+		conf, err := localTLSConfig("test", lt, "127.0.0.1")
+		c.Assert(err, qt.IsNil)
+		addr := serveTLSRelay(c, conf, echoAddr)
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		c.Assert(err, qt.IsNil)
+		roots := x509.NewCertPool()
+		roots.AddCert(leaf)
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, ServerName: "app.internal"})
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		assertEcho(c, conn, "hello app")
+	})
+
+	c.Run("missing files", func(c *qt.C) {
+		lt, err := config.NewLocalTLS("nope.pem", "nope.key")
+		c.Assert(err, qt.IsNil)
+		_, err = localTLSConfig("test", lt, "127.0.0.1")
+		c.Assert(err, qt.ErrorMatches, "failed to load certificate: .*")
+	})
+}
+
+// startTLSEcho starts a TLS server which echoes back what it receives,
+// returning its address and certificate.
+func startTLSEcho(c *qt.C, host string) (string, tls.Certificate) {
+	cert, err := selfSignedCert(host)
+	c.Assert(err, qt.IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), cert
+}
+
+func TestRemoteTLS(t *testing.T) {
+	c := qt.New(t)
+	addr, cert := startTLSEcho(c, "xxx.onion")
+	fingerprint := certFingerprint(cert.Certificate[0])
+	caFile := filepath.Join(c.Mkdir(), "ca.pem")
+	c.Assert(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600), qt.IsNil)
+
+	tests := []struct {
+		name        string
+		serverName  string
+		fingerprint string
+		caFile      string
+		ok          bool
+	}{{
+		name:        "pinned fingerprint",
+		fingerprint: fingerprint,
+		ok:          true,
+	}, {
+		name:        "wrong fingerprint",
+		fingerprint: strings.Repeat("00", 32),
+	}, {
+		name:   "CA bundle",
+		caFile: caFile,
+		ok:     true,
+	}, {
+		name:       "CA bundle with wrong server name",
+		serverName: "yyy.onion",
+		caFile:     caFile,
+	}, {
+		name:        "CA bundle and fingerprint",
+		fingerprint: fingerprint,
+		caFile:      caFile,
+		ok:          true,
+	}}
+	for _, test := range tests {
+		c.Run(test.name, func(c *qt.C) {
+			rt, err := config.NewRemoteTLS(test.serverName, test.fingerprint, test.caFile)
+			c.Assert(err, qt.IsNil)
+			conf, err := remoteTLSConfig(rt, "xxx.onion")
+			c.Assert(err, qt.IsNil)
+			_, relayAddr := startRelay(c, config.Limits{}, func(ctx context.Context) (net.Conn, error) {
+				conn, err := dialTCP(addr)(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return originateTLS(ctx, conn, conf)
+			})
+			conn, err := net.Dial("tcp", relayAddr)
+			c.Assert(err, qt.IsNil)
+			defer conn.Close()
+			if test.ok {
+				assertEcho(c, conn, "hello plaintext")
+			} else {
+				assertClosed(c, conn, 5*time.Second)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package secrets
+
+import (
+	"encoding/base32"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Contact is an onion service in the address book, which may be imported by
+// its name rather than its onion address.
+type Contact struct {
+	// Address is the onion ID of the service, without the .onion suffix.
+	Address string `json:"address"`
+	// Auth is the client identity name or private key used to authorize with
+	// the service, if it requires client authorization.
+	Auth string `json:"auth,omitempty"`
+}
+
+// contactNameRE matches contact names. Names have no dots, so that they are
+// never mistaken for onion addresses or fully qualified host names.
+var contactNameRE = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// onionIDLen is the length of a v3 onion service ID.
+const onionIDLen = 56
+
+// ParseOnionID returns the onion ID of an onion address, which may be given
+// with or without the .onion suffix.
+func ParseOnionID(address string) (string, error) {
+	onionID := strings.ToLower(strings.TrimSuffix(address, ".onion"))
+	if len(onionID) != onionIDLen {
+		return "", fmt.Errorf("invalid onion address %q", address)
+	}
+	if _, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(onionID)); err != nil {
+		return "", fmt.Errorf("invalid onion address %q: %w", address, err)
+	}
+	return onionID, nil
+}
+
+// AddContact adds a contact to the address book. The contact's client
+// authorization, if any, must resolve to a client private key.
+func (s *Secrets) AddContact(name string, contact Contact) error {
+	if !contactNameRE.MatchString(name) {
+		return fmt.Errorf("invalid contact name %q", name)
+	}
+	if _, ok := s.Contacts[name]; ok {
+		return fmt.Errorf("contact %q already exists", name)
+	}
+	onionID, err := ParseOnionID(contact.Address)
+	if err != nil {
+		return err
+	}
+	contact.Address = onionID
+	if contact.Auth != "" {
+		if _, err := s.ResolveClientPrivateKey(contact.Auth); err != nil {
+			return err
+		}
+	}
+	if s.Contacts == nil {
+		s.Contacts = map[string]Contact{}
+	}
+	s.Contacts[name] = contact
+	s.changed = true
+	return nil
+}
+
+// RemoveContact removes a contact from the address book.
+func (s *Secrets) RemoveContact(name string) error {
+	if _, ok := s.Contacts[name]; !ok {
+		return fmt.Errorf("contact %q not found", name)
+	}
+	delete(s.Contacts, name)
+	s.changed = true
+	return nil
+}
+
+// LookupContact returns the onion ID and client authorization of the named
+// contact, and whether the contact is in the address book.
+func (s *Secrets) LookupContact(name string) (onionID, auth string, ok bool) {
+	contact, ok := s.Contacts[name]
+	return contact.Address, contact.Auth, ok
+}
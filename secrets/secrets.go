@@ -20,6 +20,7 @@ type Secrets struct {
 	Version     string                   `json:"version"`
 	ServiceKeys map[string][]byte        `json:"serviceKeys"`
 	ClientKeys  map[string]ClientKeyPair `json:"clientKeys"`
+	Contacts    map[string]Contact       `json:"contacts,omitempty"`
 
 	path    string
 	changed bool
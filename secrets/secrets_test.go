@@ -2,6 +2,7 @@ package secrets
 
 import (
 	"os"
+	"strings"
 	"testing"
 
 	qt "github.com/frankban/quicktest"
@@ -88,3 +89,42 @@ func TestClientSecrets(t *testing.T) {
 	clients := sec.ClientsPublic()
 	c.Assert(clients, qt.HasLen, 2)
 }
+
+func TestContacts(t *testing.T) {
+	c := qt.New(t)
+	dir := c.Mkdir()
+	path := dir + "/sec.json"
+	sec, err := ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	_, err = sec.EnsureClientKey("me")
+	c.Assert(err, qt.IsNil)
+
+	onionID := strings.Repeat("a", 56)
+	err = sec.AddContact("bob-wiki", Contact{Address: strings.ToUpper(onionID) + ".onion", Auth: "me"})
+	c.Assert(err, qt.IsNil)
+	err = sec.AddContact("bob-wiki", Contact{Address: onionID})
+	c.Assert(err, qt.ErrorMatches, `contact "bob-wiki" already exists`)
+	err = sec.AddContact("bob.wiki", Contact{Address: onionID})
+	c.Assert(err, qt.ErrorMatches, `invalid contact name "bob.wiki"`)
+	err = sec.AddContact("alice", Contact{Address: "xxx.onion"})
+	c.Assert(err, qt.ErrorMatches, `invalid onion address "xxx.onion"`)
+	err = sec.AddContact("alice", Contact{Address: onionID, Auth: "nobody"})
+	c.Assert(err, qt.ErrorMatches, `failed to resolve client key "nobody"`)
+
+	err = sec.WriteFile()
+	c.Assert(err, qt.IsNil)
+	sec2, err := ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(sec2.Contacts, qt.DeepEquals, map[string]Contact{
+		"bob-wiki": {Address: onionID, Auth: "me"},
+	})
+	address, auth, ok := sec2.LookupContact("bob-wiki")
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(address, qt.Equals, onionID)
+	c.Assert(auth, qt.Equals, "me")
+	_, _, ok = sec2.LookupContact("alice")
+	c.Assert(ok, qt.IsFalse)
+
+	c.Assert(sec2.RemoveContact("bob-wiki"), qt.IsNil)
+	c.Assert(sec2.RemoveContact("bob-wiki"), qt.ErrorMatches, `contact "bob-wiki" not found`)
+}